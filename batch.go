@@ -0,0 +1,113 @@
+package nopfs
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+)
+
+// streamBatchSize is the maximum number of CIDs that StreamCidsBlocked
+// checks at once.
+const streamBatchSize = 256
+
+// lookupBatchSize is the number of CIDs that AreCidsBlocked checks with the
+// same indexes. Reloads and Close wait for the lookups using the indexes
+// they replace, so they are not held for the whole of large batches.
+const lookupBatchSize = 256
+
+// AreCidsBlocked returns the blocking status of several CIDs, in the same
+// order, as IsCidBlocked() would. It is cheaper than calling IsCidBlocked()
+// for each of them: the indexes of every denylist are obtained once for
+// every lookupBatchSize CIDs and the buffers used to hash them are reused.
+// Denylists that are reloaded, added or removed while a group of CIDs is
+// checked are only seen by the following ones.
+func (blocker *Blocker) AreCidsBlocked(cids []cid.Cid) []StatusResponse {
+	resps := make([]StatusResponse, len(cids))
+	var lh lookupHashes
+	for start := 0; start < len(cids); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(cids) {
+			end = len(cids)
+		}
+		blocker.checkCids(cids[start:end], resps[start:end], &lh)
+	}
+	return resps
+}
+
+// checkCids checks the CIDs with the same indexes for every denylist,
+// storing their status in resps.
+func (blocker *Blocker) checkCids(cids []cid.Cid, resps []StatusResponse, lh *lookupHashes) {
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+
+	for _, dl := range blocker.denylists {
+		dl.checkExpiry()
+	}
+	// The cache generation is read before obtaining the indexes, so
+	// that responses are not cached if they are replaced meanwhile.
+	var gen uint64
+	if blocker.cfg.cache != nil {
+		gen = blocker.cfg.cache.currentGeneration()
+	}
+	idxs := make([]*denylistIndexes, len(blocker.denylists))
+	for i, dl := range blocker.denylists {
+		idxs[i] = dl.acquireIndexes()
+	}
+	defer func() {
+		for i, dl := range blocker.denylists {
+			dl.releaseIndexes(idxs[i])
+		}
+	}()
+
+	for i, c := range cids {
+		lh.reset()
+		resps[i] = blocker.checkCid(c, lh, idxs, gen)
+	}
+}
+
+// StreamCidsBlocked checks the CIDs received from a channel and sends their
+// blocking status to the returned channel, in the same order. CIDs that are
+// available at once are checked together (see AreCidsBlocked). The returned
+// channel is closed when the given channel is closed or the context is
+// cancelled, and must be read until then.
+func (blocker *Blocker) StreamCidsBlocked(ctx context.Context, cids <-chan cid.Cid) <-chan StatusResponse {
+	out := make(chan StatusResponse, streamBatchSize)
+	go func() {
+		defer close(out)
+		batch := make([]cid.Cid, 0, streamBatchSize)
+		for {
+			// Wait for a CID, then take any others available.
+			select {
+			case c, ok := <-cids:
+				if !ok {
+					return
+				}
+				batch = append(batch, c)
+			case <-ctx.Done():
+				return
+			}
+		fill:
+			for len(batch) < streamBatchSize {
+				select {
+				case c, ok := <-cids:
+					if !ok {
+						break fill
+					}
+					batch = append(batch, c)
+				default:
+					break fill
+				}
+			}
+
+			for _, resp := range blocker.AreCidsBlocked(batch) {
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+			batch = batch[:0]
+		}
+	}()
+	return out
+}
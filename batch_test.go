@@ -0,0 +1,161 @@
+package nopfs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestAreCidsBlocked(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	// sha256(bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e/)
+	legacyCid := cid.MustParse("bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e")
+	// Multihashes longer than the hashing buffers.
+	sha512, err := multihash.Sum([]byte("long"), multihash.SHA2_512, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longCid := cid.NewCidV1(cid.Raw, sha512)
+	doubleHash, err := multihash.Sum([]byte(sha512.B58String()), multihash.SHA2_512, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream.deny")
+	writeTestDenylist(t, upstream, "/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid2.String()+"\n"+
+		"//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7\n//"+doubleHash.B58String()+"\n")
+	local := filepath.Join(dir, "local.deny")
+	writeTestDenylist(t, local, "hints:\n  priority: 10\n---\n+/ipfs/"+testCid2.String()+"\n")
+
+	for _, opts := range [][]Option{
+		{WithFollow(false)},
+		{WithFollow(false), WithBloomFilter(false), WithCache(10)},
+	} {
+		blocker, err := NewBlocker([]string{upstream, local}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cids := []cid.Cid{testCid1, testCid2, testCid3, legacyCid, longCid, testCid1}
+		for i := 0; i < 20; i++ {
+			cids = append(cids, cid.NewCidV1(cid.Raw, bloomTestKey(i)))
+		}
+		resps := blocker.AreCidsBlocked(cids)
+		if len(resps) != len(cids) {
+			t.Fatalf("expected %d responses, got %d", len(cids), len(resps))
+		}
+		for i, c := range cids {
+			expected := blocker.IsCidBlocked(c)
+			if resps[i].Cid != c || resps[i].Status != expected.Status || resps[i].Entry.Line != expected.Entry.Line {
+				t.Errorf("%s: expected %s, got %s", c, expected, resps[i])
+			}
+		}
+		for i, st := range []Status{StatusBlocked, StatusAllowed, StatusNotFound, StatusBlocked, StatusBlocked} {
+			if resps[i].Status != st {
+				t.Errorf("%s: expected %s, got %s", cids[i], st, resps[i])
+			}
+		}
+
+		// Streaming, in order.
+		in := make(chan cid.Cid)
+		out := blocker.StreamCidsBlocked(context.Background(), in)
+		go func() {
+			for _, c := range cids {
+				in <- c
+			}
+			close(in)
+		}()
+		i := 0
+		for resp := range out {
+			if resp.Cid != cids[i] || resp.Status != resps[i].Status {
+				t.Errorf("stream response %d: expected %s, got %s", i, resps[i], resp)
+			}
+			i++
+		}
+		if i != len(cids) {
+			t.Errorf("expected %d streamed responses, got %d", len(cids), i)
+		}
+
+		// Cancelling closes the output.
+		ctx, cancel := context.WithCancel(context.Background())
+		out = blocker.StreamCidsBlocked(ctx, make(chan cid.Cid))
+		cancel()
+		if _, ok := <-out; ok {
+			t.Error("no responses expected after cancelling")
+		}
+		blocker.Close()
+	}
+}
+
+func TestAreCidsBlockedCacheGeneration(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fname, "/ipfs/"+testCid1.String()+"\n")
+	blocker, err := NewBlocker([]string{fname}, WithFollow(false), WithCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	// A batch obtains the generation and the indexes, then the
+	// denylist is reloaded before the CID is checked: the response,
+	// computed from the old rules, is not cached.
+	cache := blocker.cfg.cache
+	dl := blocker.denylists[0]
+	gen := cache.currentGeneration()
+	idxs := []*denylistIndexes{dl.acquireIndexes()}
+	cache.invalidate()
+	var lh lookupHashes
+	if resp := blocker.checkCid(testCid1, &lh, idxs, gen); resp.Status != StatusBlocked {
+		t.Errorf("expected %s to be blocked: %s", testCid1, resp)
+	}
+	dl.releaseIndexes(idxs[0])
+	if _, _, ok := cache.get(cacheKey{kind: 'c', key: testCid1.KeyString()}); ok {
+		t.Error("the response from the old indexes should not be cached")
+	}
+
+	// Batches larger than lookupBatchSize are checked in groups.
+	cids := make([]cid.Cid, 2*lookupBatchSize+1)
+	for i := range cids {
+		cids[i] = testCid2
+	}
+	cids[len(cids)-1] = testCid1
+	resps := blocker.AreCidsBlocked(cids)
+	if resps[0].Status != StatusNotFound || resps[len(resps)-1].Status != StatusBlocked {
+		t.Errorf("unexpected responses: %s, %s", resps[0], resps[len(resps)-1])
+	}
+}
+
+func BenchmarkAreCidsBlocked(b *testing.B) {
+	blocker := &Blocker{cfg: newConfig(nil)}
+	for i := 0; i < 5; i++ {
+		dl := newLookupBenchDenylist(b)
+		dl.Filename = fmt.Sprintf("list%d", i)
+		blocker.addDenylist(dl)
+	}
+	cids := make([]cid.Cid, 1000)
+	for i := range cids {
+		cids[i] = cid.NewCidV1(cid.DagProtobuf, bloomTestKey(-1-i))
+	}
+
+	b.Run("IsCidBlocked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, c := range cids {
+				blocker.IsCidBlocked(c)
+			}
+		}
+	})
+	b.Run("AreCidsBlocked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			blocker.AreCidsBlocked(cids)
+		}
+	})
+}
@@ -1,6 +1,12 @@
 package nopfs
 
 import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/ipfs/boxo/path"
 	"github.com/ipfs/go-cid"
 	"go.uber.org/multierr"
@@ -8,29 +14,81 @@ import (
 
 // A Blocker binds together multiple Denylists and can decide whether a path
 // or a CID is blocked.
+//
+// Denylists are kept in order of precedence: allowlists (".allow" files, see
+// Denylist.IsAllowlist()) come before all other denylists. Among each of
+// them, denylists with higher priority (see Denylist.Priority()) come first,
+// and denylists with the same priority keep the order in which they were
+// added to the Blocker (i.e. the order of the files given to
+// NewBlocker()). Lookups consult the denylists in that order and the first
+// one that blocks or allows an item decides. Thus, an allow rule in a
+// denylist overrides block rules in denylists that come after it, and vice
+// versa, and the rules in allowlists override any denylist. Use
+// ListDenylists() to get them.
 type Blocker struct {
-	Denylists map[string]*Denylist
+	// denylists may change when following folders or when denylists
+	// are added or removed at runtime.
+	denylists []*Denylist
+
+	// mu protects denylists, which are replaced rather than modified
+	// in place. It is only held for writing while swapping them, so
+	// lookups are not paused while denylists are opened or closed.
+	mu      sync.RWMutex
+	cfg     config
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+
+	// The fields below are only used when following folders (see
+	// NewDirBlocker). roots holds the given folders and dirs the watched
+	// ones. missing holds the given folders that do not exist, and
+	// parents the folders watched for their creation. They are only used
+	// by the goroutine processing folder events. unloads holds the
+	// pending unloads of removed files, stopped on Close.
+	roots     []string
+	dirs      map[string]struct{}
+	missing   map[string]struct{}
+	parents   map[string]struct{}
+	unloadsMu sync.Mutex
+	unloads   map[*time.Timer]struct{}
+	unloadsWg sync.WaitGroup
+	closing   bool
 }
 
 // NewBlocker creates a Blocker using the given denylist file paths.
 // For default denylist locations, you can use GetDenylistFiles().
-// TODO: Options.
-func NewBlocker(files []string) (*Blocker, error) {
-
+// See the With* functions for available options. Denylist files are opened
+// and parsed in parallel.
+func NewBlocker(files []string, opts ...Option) (*Blocker, error) {
+	cfg := newBlockerConfig(opts)
 	blocker := Blocker{
-		Denylists: make(map[string]*Denylist),
+		cfg: cfg,
 	}
 
+	// Denylists are opened in parallel, but added in order.
+	dls := make([]*Denylist, len(files))
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for i, fname := range files {
+		wg.Add(1)
+		go func(i int, fname string) {
+			defer wg.Done()
+			dls[i], errs[i] = openDenylist(fname, cfg.follow, cfg)
+		}(i, fname)
+	}
+	wg.Wait()
+
 	var errors error
-	for _, fname := range files {
-		dl, err := NewDenylist(fname, true)
-		if err != nil {
+	for i, fname := range files {
+		if err := errs[i]; err != nil {
 			errors = multierr.Append(errors, err)
-			logger.Errorf("error opening and processing %s: %s", fname, err)
-
+			cfg.logger.Errorf("error opening and processing %s: %s", fname, err)
 			continue
 		}
-		blocker.Denylists[fname] = dl
+		blocker.addDenylist(dls[i])
+	}
+	if errors != nil && cfg.errorPolicy == ErrorPolicyStrict {
+		blocker.Close()
+		return nil, errors
 	}
 
 	if n := len(multierr.Errors(errors)); n > 0 && n == len(files) {
@@ -42,26 +100,226 @@ func NewBlocker(files []string) (*Blocker, error) {
 // Close stops all denylists from being processed and watched for updates.
 func (blocker *Blocker) Close() error {
 	var err error
-	for _, dl := range blocker.Denylists {
+	if blocker.watcher != nil {
+		err = multierr.Append(err, blocker.watcher.Close())
+		<-blocker.done
+		blocker.stopUnloads()
+	}
+
+	blocker.mu.Lock()
+	defer blocker.mu.Unlock()
+	for _, dl := range blocker.denylists {
 		err = multierr.Append(err, dl.Close())
 	}
 	return err
 }
 
+// Errors returned when adding and removing denylists at runtime.
+var (
+	ErrDenylistExists   = errors.New("denylist already loaded")
+	ErrDenylistNotFound = errors.New("denylist not found")
+)
+
+// AddDenylistFile opens a denylist file and adds it to a running Blocker,
+// in the position given by its priority. The denylist is followed for
+// updates unless disabled with WithFollow (NewDirBlocker() blockers always
+// follow), and uses the options the Blocker was created with. It can be
+// removed with RemoveDenylist(fname). ErrDenylistExists is returned if a
+// denylist with the same filename is loaded already.
+//
+// The file is opened and parsed before adding it, without pausing
+// concurrent lookups.
+func (blocker *Blocker) AddDenylistFile(fname string) error {
+	follow := blocker.cfg.follow || blocker.watcher != nil
+	return blocker.addNewDenylist(fname, func() (*Denylist, error) {
+		return openDenylist(fname, follow, blocker.cfg)
+	})
+}
+
+// AddDenylistReader processes a denylist from the given reader and adds
+// it to a running Blocker, like AddDenylistFile(). The name is used as
+// its Filename, to identify it in responses and to remove it with
+// RemoveDenylist(name). Snapshots are not used for these denylists.
+func (blocker *Blocker) AddDenylistReader(name string, r io.ReadSeekCloser) error {
+	return blocker.addNewDenylist(name, func() (*Denylist, error) {
+		return openDenylistReader(name, r, blocker.cfg)
+	})
+}
+
+// addNewDenylist opens a denylist with the given function, unless one
+// with the same filename is loaded already, and adds it.
+func (blocker *Blocker) addNewDenylist(fname string, open func() (*Denylist, error)) error {
+	blocker.mu.RLock()
+	i := blocker.findDenylist(fname)
+	blocker.mu.RUnlock()
+	if i >= 0 {
+		return ErrDenylistExists
+	}
+
+	dl, err := open()
+	if err != nil {
+		return err
+	}
+
+	blocker.mu.Lock()
+	added := blocker.addDenylist(dl)
+	blocker.mu.Unlock()
+	if !added {
+		// Added by someone else in the meantime.
+		dl.Close()
+		return ErrDenylistExists
+	}
+	blocker.cfg.logger.Infof("Added denylist %s", fname)
+	return nil
+}
+
+// RemoveDenylist removes the denylist with the given filename (or name,
+// for denylists added with AddDenylistReader()) from a running Blocker and
+// closes it, which stops following it. Lookups in progress finish using
+// it. ErrDenylistNotFound is returned when there is no such denylist.
+//
+// Note that denylists in folders watched by NewDirBlocker() blockers are
+// loaded again if their files are modified.
+func (blocker *Blocker) RemoveDenylist(fname string) error {
+	blocker.mu.Lock()
+	dl := blocker.removeDenylist(fname)
+	blocker.mu.Unlock()
+	if dl == nil {
+		return ErrDenylistNotFound
+	}
+	blocker.cfg.logger.Infof("Removed denylist %s", fname)
+	blocker.cfg.events.emit(Event{Type: EventDenylistRemoved, Filename: fname})
+	return dl.Close()
+}
+
+// ListDenylists returns the denylists in use, in order of precedence. The
+// returned slice is not modified when denylists are added or removed
+// afterwards.
+func (blocker *Blocker) ListDenylists() []*Denylist {
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+	return blocker.denylists
+}
+
+// addDenylist inserts a denylist in the right position according to its
+// priority. It returns false if a denylist with the same filename exists
+// already. The caller must hold the lock.
+func (blocker *Blocker) addDenylist(dl *Denylist) bool {
+	if blocker.findDenylist(dl.Filename) >= 0 {
+		return false
+	}
+
+	// Allowlists go before all denylists.
+	prio := dl.Priority()
+	allow := dl.IsAllowlist()
+	pos := len(blocker.denylists)
+	for i, other := range blocker.denylists {
+		if allow && !other.IsAllowlist() ||
+			allow == other.IsAllowlist() && other.Priority() < prio {
+			pos = i
+			break
+		}
+	}
+
+	// Copy rather than modify in place.
+	dls := make([]*Denylist, 0, len(blocker.denylists)+1)
+	dls = append(dls, blocker.denylists[:pos]...)
+	dls = append(dls, dl)
+	dls = append(dls, blocker.denylists[pos:]...)
+	blocker.denylists = dls
+	blocker.cfg.cache.invalidate()
+	return true
+}
+
+// removeDenylist removes the denylist with the given filename and returns
+// it, or nil if not found. The caller must hold the lock.
+func (blocker *Blocker) removeDenylist(fname string) *Denylist {
+	i := blocker.findDenylist(fname)
+	if i < 0 {
+		return nil
+	}
+	dl := blocker.denylists[i]
+	dls := make([]*Denylist, 0, len(blocker.denylists)-1)
+	dls = append(dls, blocker.denylists[:i]...)
+	dls = append(dls, blocker.denylists[i+1:]...)
+	blocker.denylists = dls
+	blocker.cfg.cache.invalidate()
+	return dl
+}
+
+// findDenylist returns the position of the denylist with the given filename
+// or -1. The caller must hold the lock.
+func (blocker *Blocker) findDenylist(fname string) int {
+	for i, dl := range blocker.denylists {
+		if dl.Filename == fname {
+			return i
+		}
+	}
+	return -1
+}
+
 // IsCidBlocked returns blocking status for a CID. A CID is blocked when a
 // Denylist reports it as blocked. A CID is not blocked when no denylist
 // reports it as blocked or it is explicitally allowed. Lookup stops as soon
 // as a defined "blocked" or "allowed" status is found.
 //
-// Lookup for "allowed" or "blocked" status happens in order of the denylist,
-// thus the denylist position during Blocker creation affects which one has
-// preference.
+// Lookup for "allowed" or "blocked" status happens in order of precedence
+// of the denylists (see Blocker), thus the first denylist defining a status
+// has preference.
 //
 // Note that StatusResponse.Path will be unset. See Denylist.IsCidBlocked()
 // for more info.
 func (blocker *Blocker) IsCidBlocked(c cid.Cid) StatusResponse {
-	for _, dl := range blocker.Denylists {
-		resp := dl.IsCidBlocked(c)
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+
+	// The double-hashes of the CID are computed once and shared by
+	// the bloom filter and all the denylists.
+	var lh lookupHashes
+	return blocker.checkCid(c, &lh, nil, 0)
+}
+
+// checkCid looks up a CID using the bloom filter and the cache, when
+// enabled, before checking every denylist (see isCidBlocked). The caller
+// must hold the lock. When idxs are given, gen is the cache generation
+// obtained before them, under which responses are cached.
+func (blocker *Blocker) checkCid(c cid.Cid, lh *lookupHashes, idxs []*denylistIndexes, gen uint64) StatusResponse {
+	// Most CIDs are not blocked. Avoid looking them up in every
+	// denylist.
+	if blocker.cfg.bloom != nil && !blocker.cfg.bloom.mayBlockCid(c, blocker.cfg.legacyDoubleHash, lh) {
+		return StatusResponse{
+			Cid:    c,
+			Status: StatusNotFound,
+		}
+	}
+
+	cache := blocker.cfg.cache
+	if cache == nil {
+		return blocker.isCidBlocked(c, lh, idxs)
+	}
+	key := cacheKey{kind: 'c', key: c.KeyString()}
+	resp, currentGen, ok := cache.get(key)
+	if !ok {
+		resp = blocker.isCidBlocked(c, lh, idxs)
+		if idxs == nil {
+			gen = currentGen
+		}
+		// Not cached if the indexes changed since gen.
+		cache.put(key, gen, resp)
+	}
+	return resp
+}
+
+// isCidBlocked checks the CID in every denylist. idxs are the indexes to
+// use for each denylist, or nil to use their current ones.
+func (blocker *Blocker) isCidBlocked(c cid.Cid, lh *lookupHashes, idxs []*denylistIndexes) StatusResponse {
+	for i, dl := range blocker.denylists {
+		var resp StatusResponse
+		if idxs != nil {
+			resp = dl.checkCid(idxs[i], c, lh)
+		} else {
+			resp = dl.isCidBlocked(c, lh)
+		}
 		if resp.Status != StatusNotFound {
 			return resp
 		}
@@ -77,15 +335,36 @@ func (blocker *Blocker) IsCidBlocked(c cid.Cid) StatusResponse {
 // denylist reports it as blocked or it is explicitally allowed. Lookup stops
 // as soon as a defined "blocked" or "allowed" status is found.
 //
-// Lookup for "allowed" or "blocked" status happens in order of the denylist,
-// thus the denylist position during Blocker creation affects which one has
-// preference.
+// Lookup for "allowed" or "blocked" status happens in order of precedence
+// of the denylists (see Blocker), thus the first denylist defining a status
+// has preference.
 //
 // Note that StatusResponse.Cid will be unset. See Denylist.IsPathBlocked()
 // for more info.
 func (blocker *Blocker) IsPathBlocked(p path.Path) StatusResponse {
-	for _, dl := range blocker.Denylists {
-		resp := dl.IsPathBlocked(p)
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+
+	cache := blocker.cfg.cache
+	if cache == nil {
+		var lh lookupHashes
+		return blocker.isPathBlocked(p, &lh)
+	}
+	key := cacheKey{kind: 'p', key: p.String()}
+	resp, gen, ok := cache.get(key)
+	if !ok {
+		var lh lookupHashes
+		resp = blocker.isPathBlocked(p, &lh)
+		cache.put(key, gen, resp)
+	}
+	return resp
+}
+
+// isPathBlocked checks the path in every denylist. The double-hashes of the
+// path are computed once and shared by all of them.
+func (blocker *Blocker) isPathBlocked(p path.Path, lh *lookupHashes) StatusResponse {
+	for _, dl := range blocker.denylists {
+		resp := dl.isPathBlocked(p, lh)
 		if resp.Status != StatusNotFound {
 			return resp
 		}
@@ -95,3 +374,12 @@ func (blocker *Blocker) IsPathBlocked(p path.Path) StatusResponse {
 		Status: StatusNotFound,
 	}
 }
+
+// CacheStats returns the counters of the lookup cache (see WithCache). They
+// are zero when the cache is disabled.
+func (blocker *Blocker) CacheStats() CacheStats {
+	if blocker.cfg.cache == nil {
+		return CacheStats{}
+	}
+	return blocker.cfg.cache.stats()
+}
@@ -0,0 +1,371 @@
+package nopfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// removalGracePeriod is how long we wait before unloading a denylist whose
+// file was removed or renamed. Editors and deploy tools often replace files
+// by removing or renaming them and creating a new one right after. The
+// Denylist picks up the new file by itself, so we only unload it when no new
+// file has appeared by then.
+var removalGracePeriod = time.Second
+
+// NewDirBlocker creates a Blocker that loads all the denylists found in the
+// given folders (see GetDenylistFilesInDir) and keeps watching the folders
+// for changes. New ".deny" files are loaded as they appear and denylists
+// whose files or folders are removed are closed and unloaded. Every loaded
+// denylist is followed for updates. Denylists with the same priority take
+// precedence in the order they are loaded: first the existing ones, in the
+// order of the given folders and sorted by name, then new ones as they
+// appear.
+//
+// Given folders that do not exist, or that are removed later, are watched
+// for through their nearest existing parent and their denylists are loaded
+// once they are created. For the default denylist locations, you can use
+// GetDenylistDirs(). The same options as for NewBlocker() can be used, but
+// WithFollow is ignored.
+func NewDirBlocker(dirs []string, opts ...Option) (*Blocker, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	blocker := Blocker{
+		cfg:     newBlockerConfig(opts),
+		watcher: watcher,
+		done:    make(chan struct{}),
+		dirs:    make(map[string]struct{}),
+		missing: make(map[string]struct{}),
+		parents: make(map[string]struct{}),
+		unloads: make(map[*time.Timer]struct{}),
+	}
+
+	var files []string
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		blocker.roots = append(blocker.roots, dir)
+		dirFiles, err := blocker.watchDir(dir)
+		if os.IsNotExist(err) {
+			blocker.cfg.logger.Warnf("%s does not exist, it will be watched for denylists once created", dir)
+			blocker.missing[dir] = struct{}{}
+			_, err = blocker.watchParents()
+		}
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+
+	for _, fname := range files {
+		if err := blocker.loadDenylist(fname); err != nil && blocker.cfg.errorPolicy == ErrorPolicyStrict {
+			// followDirs is not running, so Close must not
+			// wait for it.
+			close(blocker.done)
+			blocker.Close()
+			return nil, err
+		}
+	}
+
+	go blocker.followDirs()
+	return &blocker, nil
+}
+
+// watchDir adds watches to a folder and its subfolders and returns the
+// denylist files found in them. The error satisfies os.IsNotExist when the
+// folder does not exist.
+func (blocker *Blocker) watchDir(dir string) ([]string, error) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			blocker.dirs[filepath.Clean(path)] = struct{}{}
+			return blocker.watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetDenylistFilesInDir(dir)
+}
+
+// watchParents watches the nearest existing parent of every missing folder,
+// and stops watching the parents that are no longer needed. It returns
+// whether the watched parents changed.
+func (blocker *Blocker) watchParents() (bool, error) {
+	needed := make(map[string]struct{})
+	for dir := range blocker.missing {
+		needed[nearestParent(dir)] = struct{}{}
+	}
+
+	changed := false
+	var err error
+	for p := range needed {
+		if _, ok := blocker.parents[p]; ok {
+			continue
+		}
+		changed = true
+		blocker.parents[p] = struct{}{}
+		if _, ok := blocker.dirs[p]; ok {
+			continue // watched already
+		}
+		if addErr := blocker.watcher.Add(p); addErr != nil && err == nil {
+			err = addErr
+		}
+	}
+	for p := range blocker.parents {
+		if _, ok := needed[p]; ok {
+			continue
+		}
+		changed = true
+		delete(blocker.parents, p)
+		if _, ok := blocker.dirs[p]; !ok {
+			// Fails when the folder is gone already.
+			_ = blocker.watcher.Remove(p)
+		}
+	}
+	return changed, err
+}
+
+// checkMissing watches the missing folders that have been created and
+// loads their denylists. Folders may be created in several steps (i.e.
+// "mkdir -p"), some of which may happen before the watch on their parent
+// is in place, so it looks again until the watched parents do not change.
+func (blocker *Blocker) checkMissing() {
+	for {
+		created := false
+		for dir := range blocker.missing {
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				continue
+			}
+			files, err := blocker.watchDir(dir)
+			if os.IsNotExist(err) {
+				continue // gone again
+			}
+			created = true
+			delete(blocker.missing, dir)
+			if err != nil {
+				blocker.cfg.logger.Error(err)
+			}
+			for _, f := range files {
+				_ = blocker.loadDenylist(f)
+			}
+		}
+
+		changed, err := blocker.watchParents()
+		if err != nil {
+			blocker.cfg.logger.Error(err)
+		}
+		if !created && !changed {
+			return
+		}
+	}
+}
+
+// nearestParent returns the closest existing folder containing a clean
+// path.
+func nearestParent(path string) string {
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return parent
+		}
+		if fi, err := os.Stat(parent); err == nil && fi.IsDir() {
+			return parent
+		}
+		path = parent
+	}
+}
+
+// loadDenylist opens and follows a denylist and adds it to the
+// Blocker. Errors are logged and returned.
+func (blocker *Blocker) loadDenylist(fname string) error {
+	err := blocker.addNewDenylist(fname, func() (*Denylist, error) {
+		return openDenylist(fname, true, blocker.cfg)
+	})
+	if err == ErrDenylistExists {
+		return nil
+	}
+	if err != nil {
+		blocker.cfg.logger.Errorf("error opening and processing %s: %s", fname, err)
+	}
+	return err
+}
+
+// unloadDenylist closes a denylist and removes it from the Blocker.
+func (blocker *Blocker) unloadDenylist(fname string) error {
+	blocker.mu.Lock()
+	dl := blocker.removeDenylist(fname)
+	blocker.mu.Unlock()
+
+	if dl == nil {
+		return nil
+	}
+	blocker.cfg.logger.Infof("Unloading denylist %s", fname)
+	blocker.cfg.events.emit(Event{Type: EventDenylistRemoved, Filename: fname})
+	return dl.Close()
+}
+
+// followDirs processes folder events until the watcher is closed.
+func (blocker *Blocker) followDirs() {
+	defer close(blocker.done)
+
+	for {
+		select {
+		case event, ok := <-blocker.watcher.Events:
+			if !ok {
+				return
+			}
+			blocker.handleDirEvent(event)
+		case err, ok := <-blocker.watcher.Errors:
+			if !ok {
+				return
+			}
+			blocker.cfg.logger.Error(err)
+		}
+	}
+}
+
+func (blocker *Blocker) handleDirEvent(event fsnotify.Event) {
+	fname := filepath.Clean(event.Name)
+
+	_, isParent := blocker.parents[fname]
+	_, inParent := blocker.parents[filepath.Dir(fname)]
+	if isParent || inParent {
+		// A missing folder may have been created, or the
+		// watched parent removed.
+		defer blocker.checkMissing()
+	}
+
+	_, isDir := blocker.dirs[fname]
+	_, inWatched := blocker.dirs[filepath.Dir(fname)]
+	if !isDir && !inWatched {
+		return
+	}
+
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return
+		}
+		if fi.IsDir() {
+			files, err := blocker.watchDir(fname)
+			if err != nil {
+				blocker.cfg.logger.Error(err)
+			}
+			for _, f := range files {
+				_ = blocker.loadDenylist(f)
+			}
+			return
+		}
+		if isDenylistFile(fname) {
+			_ = blocker.loadDenylist(fname)
+		}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if isDir {
+			blocker.forgetDir(fname)
+		} else if !isDenylistFile(fname) {
+			return
+		}
+		blocker.scheduleUnload(fname)
+	}
+}
+
+// forgetDir stops watching a removed or renamed folder and its subfolders.
+// If it comes back, it is watched again on creation: by the watch on its
+// parent, or as a missing folder when it is one of the given folders.
+func (blocker *Blocker) forgetDir(dir string) {
+	for d := range blocker.dirs {
+		if d == dir || inDir(d, dir) {
+			delete(blocker.dirs, d)
+			if _, ok := blocker.parents[d]; ok {
+				continue // still the parent of a missing folder
+			}
+			// Fails when the folder is gone already.
+			_ = blocker.watcher.Remove(d)
+		}
+	}
+
+	for _, root := range blocker.roots {
+		if root == dir || inDir(root, dir) {
+			blocker.missing[root] = struct{}{}
+		}
+	}
+	blocker.checkMissing()
+}
+
+// scheduleUnload unloads, after the removalGracePeriod, the denylist for a
+// removed file or the denylists in a removed folder, if their files have
+// not come back by then. Pending unloads are stopped on Close.
+func (blocker *Blocker) scheduleUnload(fname string) {
+	blocker.unloadsMu.Lock()
+	defer blocker.unloadsMu.Unlock()
+	if blocker.closing {
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(removalGracePeriod, func() {
+		blocker.unloadsMu.Lock()
+		if blocker.closing {
+			blocker.unloadsMu.Unlock()
+			return
+		}
+		delete(blocker.unloads, t)
+		blocker.unloadsWg.Add(1)
+		blocker.unloadsMu.Unlock()
+		defer blocker.unloadsWg.Done()
+
+		blocker.unloadMissing(fname)
+	})
+	blocker.unloads[t] = struct{}{}
+}
+
+// stopUnloads stops pending unloads and waits for running ones.
+func (blocker *Blocker) stopUnloads() {
+	blocker.unloadsMu.Lock()
+	blocker.closing = true
+	for t := range blocker.unloads {
+		t.Stop()
+	}
+	blocker.unloads = nil
+	blocker.unloadsMu.Unlock()
+	blocker.unloadsWg.Wait()
+}
+
+// unloadMissing unloads the denylist with the given filename, or those in
+// the given folder, whose files do not exist.
+func (blocker *Blocker) unloadMissing(fname string) {
+	var missing []string
+	for _, dl := range blocker.ListDenylists() {
+		f := filepath.Clean(dl.Filename)
+		if f != fname && !inDir(f, fname) {
+			continue
+		}
+		if _, err := os.Stat(f); err == nil {
+			continue // file is back
+		}
+		missing = append(missing, dl.Filename)
+	}
+	for _, f := range missing {
+		if err := blocker.unloadDenylist(f); err != nil {
+			blocker.cfg.logger.Error(err)
+		}
+	}
+}
+
+// inDir returns whether a clean path is inside the given clean folder, at
+// any depth.
+func inDir(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
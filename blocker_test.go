@@ -0,0 +1,519 @@
+package nopfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+// setRemovalGracePeriod shortens the removalGracePeriod for a test.
+func setRemovalGracePeriod(t *testing.T, d time.Duration) {
+	old := removalGracePeriod
+	removalGracePeriod = d
+	t.Cleanup(func() { removalGracePeriod = old })
+}
+
+func TestDirBlocker(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+	setRemovalGracePeriod(t, 100*time.Millisecond)
+
+	dir := t.TempDir()
+	writeTestDenylist(t, filepath.Join(dir, "a.deny"), "/ipfs/"+testCid1.String()+"\n")
+	writeTestDenylist(t, filepath.Join(dir, "ignored.txt"), "/ipfs/"+testCid3.String()+"\n")
+
+	missing := filepath.Join(t.TempDir(), "missing", "deny.d")
+	blocker, err := NewDirBlocker([]string{dir, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+
+	// New denylists are loaded, including in new subfolders.
+	writeTestDenylist(t, filepath.Join(dir, "b.deny"), "/ipfs/"+testCid2.String()+"\n")
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid2) })
+
+	subdir := filepath.Join(dir, "sub")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestDenylist(t, filepath.Join(subdir, "c.deny"), "/ipfs/"+testCid3.String()+"\n")
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+
+	// Removed denylists are unloaded.
+	if err := os.Remove(filepath.Join(dir, "a.deny")); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusNotFound, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+
+	if n := len(blocker.ListDenylists()); n != 2 {
+		t.Errorf("expected 2 denylists loaded, got %d", n)
+	}
+
+	// Denylists in removed folders are unloaded too.
+	if err := os.RemoveAll(subdir); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusNotFound, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+	if n := len(blocker.ListDenylists()); n != 1 {
+		t.Errorf("expected 1 denylist loaded, got %d", n)
+	}
+
+	// And in renamed ones.
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestDenylist(t, filepath.Join(subdir, "c.deny"), "/ipfs/"+testCid3.String()+"\n")
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+	if err := os.Rename(subdir, filepath.Join(t.TempDir(), "moved")); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusNotFound, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+
+	// Given folders that did not exist are watched once created, and
+	// again after being removed.
+	for i := 0; i < 2; i++ {
+		if err := os.MkdirAll(missing, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestDenylist(t, filepath.Join(missing, "d.deny"), "/ipfs/"+testCid3.String()+"\n")
+		waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+
+		if err := os.RemoveAll(filepath.Dir(missing)); err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, StatusNotFound, func() StatusResponse { return blocker.IsCidBlocked(testCid3) })
+	}
+}
+
+func TestDirBlockerCloseStopsUnloads(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+	setRemovalGracePeriod(t, 100*time.Millisecond)
+
+	dir := t.TempDir()
+	writeTestDenylist(t, filepath.Join(dir, "a.deny"), "/ipfs/"+testCid1.String()+"\n")
+	blocker, err := NewDirBlocker([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := blocker.Subscribe(10)
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+
+	if err := os.Remove(filepath.Join(dir, "a.deny")); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the removal to be seen, but not for the unload.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		blocker.unloadsMu.Lock()
+		n := len(blocker.unloads)
+		blocker.unloadsMu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the removal")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := blocker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * removalGracePeriod)
+	for {
+		select {
+		case ev := <-sub.Events():
+			if ev.Type == EventDenylistRemoved {
+				t.Fatalf("unexpected event after Close: %s", ev)
+			}
+			continue
+		default:
+		}
+		break
+	}
+}
+
+func TestBlockerPrecedence(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream.deny")
+	writeTestDenylist(t, upstream, "/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid2.String()+"\n")
+	local := filepath.Join(dir, "local.deny")
+	writeTestDenylist(t, local, "+/ipfs/"+testCid1.String()+"\n")
+	prioritized := filepath.Join(dir, "prioritized.deny")
+	writeTestDenylist(t, prioritized, "hints:\n  priority: 10\n---\n+/ipfs/"+testCid2.String()+"\n")
+
+	// Same priority: order of files decides.
+	for _, tc := range []struct {
+		files    []string
+		expected Status
+	}{
+		{[]string{upstream, local}, StatusBlocked},
+		{[]string{local, upstream}, StatusAllowed},
+	} {
+		blocker, err := NewBlocker(tc.files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForStatus(t, tc.expected, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+		// Deterministic.
+		for i := 0; i < 10; i++ {
+			if resp := blocker.IsCidBlocked(testCid1); resp.Status != tc.expected {
+				t.Fatalf("expected %s: %s", tc.expected, resp)
+			}
+		}
+		blocker.Close()
+	}
+
+	// Higher priority goes first regardless of order.
+	blocker, err := NewBlocker([]string{upstream, local, prioritized})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	if blocker.denylists[0].Filename != prioritized {
+		t.Fatal("prioritized denylist should be first")
+	}
+	waitForStatus(t, StatusAllowed, func() StatusResponse { return blocker.IsCidBlocked(testCid2) })
+}
+
+func TestBlockerAllowlists(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	writeTestDenylist(t, filepath.Join(dir, "upstream.deny"), "hints:\n  priority: 100\n---\n"+
+		"/ipfs/"+testCid1.String()+"\n"+
+		"/ipfs/"+testCid2.String()+"\n"+
+		"/ipfs/"+testCid3.String()+"/*\n")
+	// Rules in allowlists allow without prefix. The allowlist sorts
+	// after the denylist and has lower priority, but still goes first.
+	writeTestDenylist(t, filepath.Join(dir, "zlocal.allow"), "/ipfs/"+testCid1.String()+"\n"+
+		"/ipfs/"+testCid3.String()+"/a\n")
+
+	blocker, err := NewDirBlocker([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	dls := blocker.ListDenylists()
+	if len(dls) != 2 || !dls[0].IsAllowlist() || dls[1].IsAllowlist() {
+		t.Fatal("the allowlist should be first")
+	}
+
+	waitForStatus(t, StatusAllowed, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid2) })
+	for _, tc := range []struct {
+		path     string
+		expected Status
+	}{
+		{"/ipfs/" + testCid3.String() + "/a", StatusAllowed},
+		{"/ipfs/" + testCid3.String() + "/b", StatusBlocked},
+	} {
+		p, err := path.NewPath(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := blocker.IsPathBlocked(p); resp.Status != tc.expected {
+			t.Errorf("%s: expected %s: %s", tc.path, tc.expected, resp)
+		}
+	}
+}
+
+type countingLogger struct {
+	Logger
+	errors   int
+	warnings int
+}
+
+func (l *countingLogger) Error(args ...interface{}) {
+	l.errors++
+}
+
+func (l *countingLogger) Warnf(template string, args ...interface{}) {
+	l.warnings++
+}
+
+func TestBlockerOptions(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.deny")
+	// sha256(bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e/)
+	legacyCid := cid.MustParse("bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e")
+	writeTestDenylist(t, fpath, "//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7\n/ipfs/"+testCid1.String()+"\n/ipfs/wrong\n")
+
+	l := &countingLogger{Logger: logging.Logger("nopfs")}
+	blocker, err := NewBlocker([]string{fpath}, WithFollow(false), WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := blocker.IsCidBlocked(legacyCid); resp.Status != StatusBlocked {
+		t.Errorf("legacy double-hash should be blocked: %s", resp)
+	}
+	if l.errors != 1 {
+		t.Errorf("expected one logged error, got %d", l.errors)
+	}
+	blocker.Close()
+
+	blocker, err = NewBlocker([]string{fpath},
+		WithFollow(false),
+		WithLegacyDoubleHash(false),
+		WithSafeCids(map[cid.Cid]string{testCid1: "safe"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := blocker.IsCidBlocked(legacyCid); resp.Status != StatusNotFound {
+		t.Errorf("legacy double-hash lookups should be disabled: %s", resp)
+	}
+	if resp := blocker.IsCidBlocked(testCid1); resp.Status != StatusNotFound {
+		t.Errorf("safe cid should not be blocked: %s", resp)
+	}
+	blocker.Close()
+
+	for _, follow := range []bool{true, false} {
+		_, err = NewBlocker([]string{fpath}, WithFollow(follow), WithErrorPolicy(ErrorPolicyStrict))
+		if err == nil {
+			t.Error("strict policy should fail on wrong rules")
+		}
+	}
+
+	// Also when the wrong rules are in a watched folder.
+	strictDir := t.TempDir()
+	writeTestDenylist(t, filepath.Join(strictDir, "a.deny"), "/ipfs/"+testCid1.String()+"\n")
+	writeTestDenylist(t, filepath.Join(strictDir, "b.deny"), "/ipfs/wrong\n")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewDirBlocker([]string{strictDir}, WithErrorPolicy(ErrorPolicyStrict))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("strict policy should fail on wrong rules in folders")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewDirBlocker did not return")
+	}
+
+	// Header errors are logged with the given logger too.
+	badHeader := filepath.Join(dir, "bad.deny")
+	writeTestDenylist(t, badHeader, "version: 99\n---\n/ipfs/"+testCid1.String()+"\n")
+	l = &countingLogger{Logger: logging.Logger("nopfs")}
+	if _, err := NewDenylist(badHeader, false, WithLogger(l)); err == nil {
+		t.Error("unsupported version should fail")
+	}
+	if l.errors != 1 {
+		t.Errorf("expected one logged error, got %d", l.errors)
+	}
+}
+
+func TestBlockerCategories(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.deny")
+	mh, err := multihash.Sum([]byte("uncategorized"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncategorized := cid.NewCidV1(cid.Raw, mh)
+	writeTestDenylist(t, fpath, `hints:
+  category: malware
+---
+/ipfs/`+testCid1.String()+`
+/ipfs/`+testCid2.String()+` category=copyright
+/ipfs/`+testCid3.String()+` category=phishing,copyright
+/ipfs/`+uncategorized.String()+` category=
+`)
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected map[cid.Cid]Status
+	}{
+		{"all", nil, map[cid.Cid]Status{
+			testCid1:      StatusBlocked,
+			testCid2:      StatusBlocked,
+			testCid3:      StatusBlocked,
+			uncategorized: StatusBlocked,
+		}},
+		{"disabled", []Option{WithDisabledCategories("copyright")}, map[cid.Cid]Status{
+			testCid1:      StatusBlocked,
+			testCid2:      StatusNotFound,
+			testCid3:      StatusBlocked,
+			uncategorized: StatusBlocked,
+		}},
+		{"enabled", []Option{WithEnabledCategories("malware")}, map[cid.Cid]Status{
+			testCid1:      StatusBlocked,
+			testCid2:      StatusNotFound,
+			testCid3:      StatusNotFound,
+			uncategorized: StatusBlocked,
+		}},
+		{"both", []Option{WithEnabledCategories("copyright"), WithDisabledCategories("copyright", "phishing")}, map[cid.Cid]Status{
+			testCid1:      StatusNotFound,
+			testCid2:      StatusNotFound,
+			testCid3:      StatusNotFound,
+			uncategorized: StatusBlocked,
+		}},
+	} {
+		blocker, err := NewBlocker([]string{fpath}, append(tc.opts, WithFollow(false))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for c, st := range tc.expected {
+			if resp := blocker.IsCidBlocked(c); resp.Status != st {
+				t.Errorf("%s: %s: expected %s, got %s", tc.name, c, st, resp)
+			}
+		}
+		blocker.Close()
+	}
+}
+
+func TestBlockerCache(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.deny")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid3.String()+" not_before=2024-02-01T00:00:00Z\n")
+
+	blocker, err := NewBlocker([]string{fpath}, WithCache(2), WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsCidBlocked(testCid1) })
+
+	p, err := path.NewPath("/ipfs/" + testCid2.String() + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := blocker.CacheStats()
+	for i := 0; i < 3; i++ {
+		if resp := blocker.IsCidBlocked(testCid1); resp.Status != StatusBlocked {
+			t.Fatalf("%s should be blocked: %s", testCid1, resp)
+		}
+		if resp := blocker.IsPathBlocked(p); resp.Status != StatusNotFound {
+			t.Fatalf("%s should not be blocked: %s", p, resp)
+		}
+	}
+	stats := blocker.CacheStats()
+	// testCid1 was cached by waitForStatus.
+	if hits := stats.Hits - before.Hits; hits != 5 {
+		t.Errorf("expected 5 hits, got %d", hits)
+	}
+	if stats.Entries != 2 {
+		t.Errorf("expected 2 cached entries, got %d", stats.Entries)
+	}
+
+	// New rules invalidate the cache.
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("/ipfs/" + testCid2.String() + "/a\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return blocker.IsPathBlocked(p) })
+
+	// The cache is bounded.
+	blocker.IsCidBlocked(testCid3)
+	if stats := blocker.CacheStats(); stats.Entries != 2 {
+		t.Errorf("expected 2 cached entries, got %d", stats.Entries)
+	}
+
+	// Rules that become active invalidate the cache.
+	if resp := blocker.IsCidBlocked(testCid3); resp.Status != StatusNotFound {
+		t.Fatalf("%s should not be blocked yet: %s", testCid3, resp)
+	}
+	clock.Set(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	if resp := blocker.IsCidBlocked(testCid3); resp.Status != StatusBlocked {
+		t.Errorf("%s should be blocked: %s", testCid3, resp)
+	}
+}
+
+func TestBlockerAddRemoveDenylists(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream.deny")
+	writeTestDenylist(t, upstream, "/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid2.String()+"\n")
+	local := filepath.Join(dir, "local.deny")
+	writeTestDenylist(t, local, "hints:\n  priority: 10\n---\n+/ipfs/"+testCid1.String()+"\n")
+
+	blocker, err := NewBlocker([]string{upstream}, WithFollow(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	// Lookups keep running while denylists come and go.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				blocker.IsCidBlocked(testCid2)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	emergency := "/ipfs/" + testCid3.String() + "\n"
+	if err := blocker.AddDenylistReader("emergency", testReader{strings.NewReader(emergency)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := blocker.IsCidBlocked(testCid3); resp.Status != StatusBlocked || resp.Filename != "emergency" {
+		t.Errorf("%s should be blocked by the emergency list: %s", testCid3, resp)
+	}
+	if err := blocker.AddDenylistReader("emergency", testReader{strings.NewReader(emergency)}); err != ErrDenylistExists {
+		t.Errorf("expected ErrDenylistExists, got %v", err)
+	}
+
+	if err := blocker.AddDenylistFile(local); err != nil {
+		t.Fatal(err)
+	}
+	if resp := blocker.IsCidBlocked(testCid1); resp.Status != StatusAllowed {
+		t.Errorf("%s should be allowed by the prioritized list: %s", testCid1, resp)
+	}
+	var names []string
+	for _, dl := range blocker.ListDenylists() {
+		names = append(names, dl.Filename)
+	}
+	if expected := []string{local, upstream, "emergency"}; strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected denylists %v, got %v", expected, names)
+	}
+
+	if err := blocker.RemoveDenylist(upstream); err != nil {
+		t.Fatal(err)
+	}
+	if resp := blocker.IsCidBlocked(testCid2); resp.Status != StatusNotFound {
+		t.Errorf("%s should not be blocked after removing its list: %s", testCid2, resp)
+	}
+	if err := blocker.RemoveDenylist(upstream); err != ErrDenylistNotFound {
+		t.Errorf("expected ErrDenylistNotFound, got %v", err)
+	}
+	if n := len(blocker.ListDenylists()); n != 2 {
+		t.Errorf("expected 2 denylists, got %d", n)
+	}
+}
@@ -1,34 +1,163 @@
 package nopfs
 
-import "sync"
+import (
+	"time"
+)
 
 // BlocksDB is a key-value store of Entries. Keying may vary depending on
-// whether we are indexing IPNS names, CIDs etc.
-type BlocksDB struct {
-	// TODO: this will eventually need to be replaced by a database with
-	// its bloom filters etc. For a few million items this is just fine
-	// though.
-	blockDB sync.Map
+// whether we are indexing IPNS names, CIDs etc. Denylists use a BlocksDB for
+// every index (IPFS, IPNS, path and double-hash rules), created with a
+// BlocksDBFactory (see WithBlocksDB).
+//
+// Store and RemoveExpired are not called concurrently with each other, but
+// Load may be called concurrently with any method: lookups do not wait for
+// rules to be stored.
+type BlocksDB interface {
+	// Load returns the Entries for a key.
+	Load(key string) (Entries, bool)
+	// Store stores a new entry with the given key. If there are
+	// existing Entries, the new Entry will be appended to them.
+	Store(key string, entry Entry) error
+	// RemoveExpired removes the entries that have expired at the given
+	// time (see Entry.ExpiredAt) and returns how many were removed.
+	RemoveExpired(t time.Time) int
+	// Close releases any resources used by the BlocksDB.
+	Close() error
 }
 
-// Load returns the Entries for a key.
-func (b *BlocksDB) Load(key string) (Entries, bool) {
-	val, ok := b.blockDB.Load(key)
-	if !ok {
-		return nil, false
+// BlocksDBFactory creates the BlocksDBs used by a Denylist. It receives the
+// filename of the denylist (empty when it is read from a reader) and the name
+// of the index ("ipfs", "ipns", "path" or "double-hash-<multihash code>").
+type BlocksDBFactory func(denylist, index string) (BlocksDB, error)
+
+// MemoryBlocksDBFactory is a BlocksDBFactory that returns MemoryBlocksDBs. It
+// is the default.
+func MemoryBlocksDBFactory(denylist, index string) (BlocksDB, error) {
+	return &MemoryBlocksDB{}, nil
+}
+
+// checkPathStatus returns whether the given path has a match in one of the
+// Entries for the given key, ignoring those for which skip returns true.
+// MemoryBlocksDBs are checked without allocating.
+func checkPathStatus(db BlocksDB, key []byte, p string, skip func(Entry) bool) (Status, Entry) {
+	if mdb, ok := db.(*MemoryBlocksDB); ok {
+		return mdb.checkPathStatus(key, p, skip)
 	}
-	entries, ok := val.(Entries)
-	if !ok {
-		logger.Error("cannot convert to entries")
+	entries, _ := db.Load(string(key))
+	return entries.checkPathStatus(p, skip)
+}
+
+// MemoryBlocksDB is an in-memory BlocksDB.
+//
+// When many Entries are stored under the same key (i.e. many subpath rules
+// for the same CID), they are additionally indexed by path so that
+// CheckPathStatus does not need to check all of them.
+//
+// Lookups do not take locks: the Entries for a key are replaced, never
+// modified, when a new Entry is stored (see lookupMap).
+type MemoryBlocksDB struct {
+	blockDB lookupMap[indexedEntries]
+}
+
+// indexedEntries holds the Entries for a key, along with an index by path
+// when there are enough of them. Entries are appended to the index while it
+// is read, but not to the entries slice, which is replaced instead.
+type indexedEntries struct {
+	entries Entries
+	index   *pathIndex
+}
+
+// Load returns the Entries for a key.
+func (b *MemoryBlocksDB) Load(key string) (Entries, bool) {
+	ie := b.blockDB.load(key)
+	if ie == nil {
 		return nil, false
 	}
-	return entries, true
+	// Limit the capacity so that appending to the result does not
+	// write to the array that later Entries are stored in.
+	return ie.entries[:len(ie.entries):len(ie.entries)], true
 }
 
 // Store stores a new entry with the given key. If there are existing Entries,
 // the new Entry will be appended to them.
-func (b *BlocksDB) Store(key string, entry Entry) {
-	entries, _ := b.Load(key)
-	entries = append(entries, entry)
-	b.blockDB.Store(key, entries)
+func (b *MemoryBlocksDB) Store(key string, entry Entry) error {
+	ie := b.blockDB.load(key)
+	if ie == nil {
+		b.blockDB.store(key, &indexedEntries{entries: Entries{entry}})
+		return nil
+	}
+
+	// Readers of ie do not look beyond its length, so appending to
+	// the same array is safe.
+	fresh := &indexedEntries{
+		entries: append(ie.entries, entry),
+		index:   ie.index,
+	}
+	switch {
+	case fresh.index != nil:
+		fresh.index.add(entry)
+	case len(fresh.entries) >= pathIndexThreshold:
+		fresh.index = newPathIndex()
+		for _, e := range fresh.entries {
+			fresh.index.add(e)
+		}
+	}
+	b.blockDB.store(key, fresh)
+	return nil
+}
+
+// CheckPathStatus returns whether the given path has a match in one of the
+// Entries for the given key, ignoring those that are not active now (see
+// Entries.CheckPathStatus).
+func (b *MemoryBlocksDB) CheckPathStatus(key, p string) (Status, Entry) {
+	return b.checkPathStatus([]byte(key), p, func(e Entry) bool {
+		return e.timed() && !e.ActiveAt(time.Now())
+	})
+}
+
+// CheckPathStatusAt works like CheckPathStatus but ignores Entries that are
+// not active at the given time.
+func (b *MemoryBlocksDB) CheckPathStatusAt(key, p string, t time.Time) (Status, Entry) {
+	return b.checkPathStatus([]byte(key), p, func(e Entry) bool {
+		return !e.ActiveAt(t)
+	})
+}
+
+func (b *MemoryBlocksDB) checkPathStatus(key []byte, p string, skip func(Entry) bool) (Status, Entry) {
+	ie := b.blockDB.loadBytes(key)
+	if ie == nil {
+		return StatusNotFound, Entry{}
+	}
+	if ie.index != nil {
+		return ie.index.checkPathStatus(p, skip)
+	}
+	return ie.entries.checkPathStatus(p, skip)
+}
+
+// RemoveExpired removes the entries that have expired at the given time
+// (see Entry.ExpiredAt) and returns how many were removed.
+func (b *MemoryBlocksDB) RemoveExpired(t time.Time) int {
+	removed := 0
+	b.blockDB.forEach(func(key string, ie *indexedEntries) {
+		kept, n := ie.entries.removeExpired(t)
+		if n == 0 {
+			return
+		}
+		removed += n
+		if len(kept) == 0 {
+			b.blockDB.delete(key)
+			return
+		}
+		fresh := &indexedEntries{entries: kept}
+		if ie.index != nil {
+			fresh.index = ie.index.removeExpired(t)
+		}
+		b.blockDB.store(key, fresh)
+	})
+	return removed
+}
+
+// Close does nothing.
+func (b *MemoryBlocksDB) Close() error {
+	return nil
 }
@@ -0,0 +1,339 @@
+package nopfs
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// diskBatchSize is the number of Entries buffered by a DiskBlocksDB before
+// writing them to disk in a single transaction.
+const diskBatchSize = 10000
+
+var diskBucket = []byte("entries")
+
+// DiskBlocksDB is a BlocksDB that keeps Entries in an embedded key-value
+// database (bbolt) on disk, using less memory than a MemoryBlocksDB at the
+// cost of slower lookups. Lookups benefit from the OS page cache.
+//
+// The database is a temporary file, removed on Close: the rules are loaded
+// from the denylist files on every start anyway (see WithSnapshots for
+// faster loading). A DiskBlocksDB holds the rules of a single denylist.
+type DiskBlocksDB struct {
+	db     *bolt.DB
+	logger Logger
+
+	// Entries are written in batches. Until then, they are kept in
+	// pending, and then in flushing while they are written. mu protects
+	// them. Loads only wait for it while a batch is committed, so that
+	// they see either the batch or the Entries in flushing.
+	mu           sync.RWMutex
+	pending      map[string]Entries
+	pendingCount int
+	flushing     map[string]Entries
+
+	// headerHints are the hints in the header of the denylist, shared
+	// by all its Entries (see Entry.Hint). They are kept once rather
+	// than with every Entry on disk.
+	headerHints map[string]string
+}
+
+// NewDiskBlocksDB creates a DiskBlocksDB backed by a new database file in the
+// given folder.
+func NewDiskBlocksDB(dir string) (*DiskBlocksDB, error) {
+	f, err := os.CreateTemp(dir, "nopfs-*.db")
+	if err != nil {
+		return nil, err
+	}
+	fname := f.Name()
+	f.Close()
+
+	// The database does not need to survive crashes, so we avoid
+	// syncing.
+	db, err := bolt.Open(fname, 0600, &bolt.Options{
+		Timeout:        time.Second,
+		NoSync:         true,
+		NoFreelistSync: true,
+	})
+	if err != nil {
+		os.Remove(fname)
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(diskBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		os.Remove(fname)
+		return nil, err
+	}
+
+	return &DiskBlocksDB{
+		db:      db,
+		logger:  logger,
+		pending: make(map[string]Entries),
+	}, nil
+}
+
+// DiskBlocksDBFactory returns a BlocksDBFactory that creates DiskBlocksDBs in
+// the given folder. They log errors with the logger of the Denylist using
+// them (see WithLogger).
+func DiskBlocksDBFactory(dir string) BlocksDBFactory {
+	return func(denylist, index string) (BlocksDB, error) {
+		return NewDiskBlocksDB(dir)
+	}
+}
+
+// Load returns the Entries for a key. Errors are logged.
+func (b *DiskBlocksDB) Load(key string) (Entries, bool) {
+	b.mu.RLock()
+	tx, err := b.db.Begin(false)
+	flushing := b.flushing[key]
+	pending := b.pending[key]
+	headerHints := b.headerHints
+	b.mu.RUnlock()
+
+	var entries Entries
+	if err == nil {
+		if v := tx.Bucket(diskBucket).Get([]byte(key)); v != nil {
+			err = decodeEntries(v, headerHints, &entries)
+		}
+		tx.Rollback()
+	}
+	if err != nil {
+		b.logger.Errorf("error loading entries for %s: %s", key, err)
+	}
+
+	entries = append(entries, flushing...)
+	entries = append(entries, pending...)
+	return entries, len(entries) > 0
+}
+
+// Store stores a new entry with the given key. If there are existing Entries,
+// the new Entry will be appended to them.
+func (b *DiskBlocksDB) Store(key string, entry Entry) error {
+	b.mu.Lock()
+	if b.headerHints == nil {
+		b.headerHints = entry.headerHints
+	}
+	b.pending[key] = append(b.pending[key], entry)
+	b.pendingCount++
+	full := b.pendingCount >= diskBatchSize
+	b.mu.Unlock()
+
+	if full {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush writes the pending Entries to disk. The Entries are encoded and
+// written without holding the lock, which is only taken to commit.
+func (b *DiskBlocksDB) flush() error {
+	b.mu.Lock()
+	batch := b.pending
+	b.flushing = batch
+	b.pending = make(map[string]Entries)
+	b.pendingCount = 0
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := b.db.Begin(true)
+	if err == nil {
+		err = b.writeBatch(tx, batch)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		err = tx.Commit()
+	} else if tx != nil {
+		tx.Rollback()
+	}
+	b.flushing = nil
+	if err != nil {
+		// Keep the batch, before any newer Entries, for the next
+		// flush.
+		for key, entries := range b.pending {
+			batch[key] = append(batch[key], entries...)
+		}
+		b.pending = batch
+		b.pendingCount = 0
+		for _, entries := range batch {
+			b.pendingCount += len(entries)
+		}
+	}
+	return err
+}
+
+func (b *DiskBlocksDB) writeBatch(tx *bolt.Tx, batch map[string]Entries) error {
+	bucket := tx.Bucket(diskBucket)
+	for key, pending := range batch {
+		var entries Entries
+		if v := bucket.Get([]byte(key)); v != nil {
+			if err := decodeEntries(v, nil, &entries); err != nil {
+				return err
+			}
+		}
+		v, err := encodeEntries(append(entries, pending...))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(key), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveExpired removes the entries that have expired at the given time
+// (see Entry.ExpiredAt) and returns how many were removed. Errors are logged.
+func (b *DiskBlocksDB) RemoveExpired(t time.Time) int {
+	if err := b.flush(); err != nil {
+		b.logger.Error(err)
+		return 0
+	}
+
+	// Stores do not happen meanwhile, so nothing is pending, and Loads
+	// see the database before or after the update.
+	removed := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+		updates := make(map[string]Entries)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var entries Entries
+			if err := decodeEntries(v, nil, &entries); err != nil {
+				return err
+			}
+			kept, n := entries.removeExpired(t)
+			if n > 0 {
+				updates[string(k)] = kept
+				removed += n
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Buckets cannot be modified while iterating.
+		for k, entries := range updates {
+			if len(entries) == 0 {
+				err = bucket.Delete([]byte(k))
+			} else {
+				var v []byte
+				v, err = encodeEntries(entries)
+				if err == nil {
+					err = bucket.Put([]byte(k), v)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.logger.Error(err)
+		return 0
+	}
+	return removed
+}
+
+// Close closes and removes the database.
+func (b *DiskBlocksDB) Close() error {
+	fname := b.db.Path()
+	err := b.db.Close()
+	if rmErr := os.Remove(fname); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// storedEntry is the representation of an Entry on disk.
+type storedEntry struct {
+	Line      uint64            `json:"l"`
+	AllowRule bool              `json:"a,omitempty"`
+	Hints     map[string]string `json:"h,omitempty"`
+	RawValue  string            `json:"r"`
+	Multihash []byte            `json:"m,omitempty"`
+	Path      string            `json:"p,omitempty"`
+	Prefix    bool              `json:"x,omitempty"`
+	Glob      []storedGlobToken `json:"g,omitempty"`
+	NotBefore *time.Time        `json:"nb,omitempty"`
+	Expires   *time.Time        `json:"e,omitempty"`
+}
+
+type storedGlobToken struct {
+	Type    globTokenType `json:"t"`
+	Literal string        `json:"l,omitempty"`
+}
+
+func encodeEntries(entries Entries) ([]byte, error) {
+	stored := make([]storedEntry, len(entries))
+	for i, e := range entries {
+		se := storedEntry{
+			Line:      e.Line,
+			AllowRule: e.AllowRule,
+			Hints:     e.RuleHints,
+			RawValue:  e.RawValue,
+			Multihash: e.Multihash,
+			Path:      e.Path.Path,
+			Prefix:    e.Path.Prefix,
+		}
+		for _, tk := range e.Path.glob {
+			se.Glob = append(se.Glob, storedGlobToken{Type: tk.typ, Literal: tk.literal})
+		}
+		if !e.NotBefore.IsZero() {
+			notBefore := e.NotBefore
+			se.NotBefore = &notBefore
+		}
+		if !e.Expires.IsZero() {
+			expires := e.Expires
+			se.Expires = &expires
+		}
+		stored[i] = se
+	}
+	return json.Marshal(stored)
+}
+
+// decodeEntries appends the Entries encoded in v to entries, with the given
+// header hints.
+func decodeEntries(v []byte, headerHints map[string]string, entries *Entries) error {
+	var stored []storedEntry
+	if err := json.Unmarshal(v, &stored); err != nil {
+		return err
+	}
+	for _, se := range stored {
+		e := Entry{
+			Line:        se.Line,
+			AllowRule:   se.AllowRule,
+			RuleHints:   se.Hints,
+			headerHints: headerHints,
+			RawValue:    se.RawValue,
+			Multihash:   se.Multihash,
+			Path: BlockedPath{
+				Path:   se.Path,
+				Prefix: se.Prefix,
+			},
+		}
+		for _, tk := range se.Glob {
+			e.Path.glob = append(e.Path.glob, globToken{typ: tk.Type, literal: tk.Literal})
+		}
+		if se.NotBefore != nil {
+			e.NotBefore = *se.NotBefore
+		}
+		if se.Expires != nil {
+			e.Expires = *se.Expires
+		}
+		*entries = append(*entries, e)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package nopfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDiskBlocksDB(t *testing.T) {
+	db, err := NewDiskBlocksDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	glob, err := NewBlockedPath("**/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries share the header hints of their denylist.
+	headerHints := map[string]string{"k": "h", "hk": "hv"}
+	entries := []Entry{
+		{Line: 1, RawValue: "a", RuleHints: map[string]string{"k": "v"}, headerHints: headerHints},
+		{Line: 2, RawValue: "b", Path: glob, AllowRule: true, headerHints: headerHints},
+		{Line: 3, RawValue: "c", Expires: now, headerHints: headerHints},
+	}
+	for i := 0; i < diskBatchSize+1; i++ { // force a flush
+		e := entries[i%len(entries)]
+		if i > 2 {
+			e.Line = uint64(i + 1)
+		}
+		if err := db.Store("key", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, ok := db.Load("key")
+	if !ok || len(loaded) != diskBatchSize+1 {
+		t.Fatalf("expected %d entries, got %d", diskBatchSize+1, len(loaded))
+	}
+	for i, e := range loaded[:3] {
+		if e.Line != entries[i].Line || e.RawValue != entries[i].RawValue || !e.Expires.Equal(entries[i].Expires) {
+			t.Errorf("entry %d was not stored correctly: %+v", i, e)
+		}
+	}
+	if loaded[0].RuleHints["k"] != "v" {
+		t.Error("hints not stored")
+	}
+	for _, i := range []int{0, diskBatchSize} { // on disk and pending
+		if v, _ := loaded[i].Hint("hk"); v != "hv" {
+			t.Errorf("header hints not stored for entry %d", i)
+		}
+	}
+	if v, _ := loaded[0].Hint("k"); v != "v" {
+		t.Error("rule hints should take precedence")
+	}
+	if !loaded[1].Path.Matches("a/b/index.html") || !loaded[1].AllowRule {
+		t.Error("glob path not stored")
+	}
+
+	if _, ok := db.Load("other"); ok {
+		t.Error("other key should not exist")
+	}
+
+	removed := db.RemoveExpired(now)
+	if removed != (diskBatchSize+1)/3 {
+		t.Errorf("expected %d removed, got %d", (diskBatchSize+1)/3, removed)
+	}
+	loaded, _ = db.Load("key")
+	for _, e := range loaded {
+		if !e.Expires.IsZero() {
+			t.Fatal("expired entry was not removed")
+		}
+	}
+}
+
+func TestDiskBlocksDBConcurrentLoads(t *testing.T) {
+	db, err := NewDiskBlocksDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Loads see every stored Entry once, including while batches are
+	// written.
+	total := 2*diskBatchSize + 10
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		last := 0
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			loaded, _ := db.Load("key")
+			for i, e := range loaded {
+				if e.Line != uint64(i+1) {
+					errs <- fmt.Errorf("entry %d has line %d", i, e.Line)
+					return
+				}
+			}
+			if len(loaded) < last {
+				errs <- fmt.Errorf("entries went from %d to %d", last, len(loaded))
+				return
+			}
+			last = len(loaded)
+		}
+	}()
+	for i := 0; i < total; i++ {
+		if err := db.Store("key", Entry{Line: uint64(i + 1), RawValue: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := db.Load("key"); len(loaded) != total {
+		t.Errorf("expected %d entries, got %d", total, len(loaded))
+	}
+}
+
+func TestCheckPathStatusAt(t *testing.T) {
+	start := time.Now()
+	expiring := Entry{Line: 1, RawValue: "a", Expires: start.Add(time.Hour)}
+
+	db := &MemoryBlocksDB{}
+	if err := db.Store("key", expiring); err != nil {
+		t.Fatal(err)
+	}
+	entries := Entries{expiring}
+
+	for _, tc := range []struct {
+		now      time.Time
+		expected Status
+	}{
+		{start, StatusBlocked},
+		{start.Add(2 * time.Hour), StatusNotFound},
+	} {
+		if st, _ := entries.CheckPathStatusAt("", tc.now); st != tc.expected {
+			t.Errorf("Entries at %s: expected %s, got %s", tc.now, tc.expected, st)
+		}
+		if st, _ := db.CheckPathStatusAt("key", "", tc.now); st != tc.expected {
+			t.Errorf("MemoryBlocksDB at %s: expected %s, got %s", tc.now, tc.expected, st)
+		}
+	}
+
+	// Without a time, the current one is used.
+	if st, _ := entries.CheckPathStatus(""); st != StatusBlocked {
+		t.Errorf("Entries: expected %s, got %s", StatusBlocked, st)
+	}
+	if st, _ := db.CheckPathStatus("key", ""); st != StatusBlocked {
+		t.Errorf("MemoryBlocksDB: expected %s, got %s", StatusBlocked, st)
+	}
+}
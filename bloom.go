@@ -0,0 +1,195 @@
+package nopfs
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// Bloom filter parameters: around 1% false positives per layer. Each new
+// layer makes the total capacity grow 4x.
+const (
+	bloomBitsPerKey   = 10
+	bloomHashes       = 7
+	bloomMinCapacity  = 1 << 16
+	bloomGrowthFactor = 3
+)
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// bloomFilter is a probabilistic set of the raw multihashes used as keys by
+// the IPFS and double-hash rules of the denylists in a Blocker. It lets the
+// Blocker answer that a CID is not blocked, which is by far the most common
+// answer, without consulting every denylist (and without encoding and
+// double-hashing the CID once per denylist).
+//
+// Keys cannot be removed: rules that are removed (expired, reloaded, unloaded
+// denylists) only cause false positives, which are resolved by the
+// denylists. The filter grows by adding layers as keys are added, as the
+// number of rules is not known in advance.
+//
+// Lookups are lock-free and can happen concurrently with additions.
+type bloomFilter struct {
+	// mu serializes additions.
+	mu     sync.Mutex
+	layers atomic.Value // []*bloomLayer
+	codes  atomic.Value // []uint64, the double-hash functions in use
+	count  int          // keys added to the last layer
+}
+
+type bloomLayer struct {
+	bits     []uint64
+	mask     uint64
+	capacity int
+}
+
+func newBloomLayer(capacity int) *bloomLayer {
+	// Round the number of bits up to a power of two so that
+	// positions can be masked.
+	nbits := uint64(64)
+	for nbits < uint64(capacity*bloomBitsPerKey) {
+		nbits <<= 1
+	}
+	return &bloomLayer{
+		bits:     make([]uint64, nbits/64),
+		mask:     nbits - 1,
+		capacity: capacity,
+	}
+}
+
+func newBloomFilter() *bloomFilter {
+	bf := &bloomFilter{}
+	bf.layers.Store([]*bloomLayer{newBloomLayer(bloomMinCapacity)})
+	bf.codes.Store([]uint64(nil))
+	return bf
+}
+
+// bloomHash returns two hashes of a key (FNV-1a based) to derive the bit
+// positions from (Kirsch-Mitzenmacher).
+func bloomHash(key []byte) (uint64, uint64) {
+	h := uint64(fnvOffset64)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return h & 0xffffffff, h>>32 | 1
+}
+
+func (l *bloomLayer) add(h1, h2 uint64) {
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) & l.mask
+		word := &l.bits[pos/64]
+		bit := uint64(1) << (pos % 64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&bit != 0 || atomic.CompareAndSwapUint64(word, old, old|bit) {
+				break
+			}
+		}
+	}
+}
+
+func (l *bloomLayer) has(h1, h2 uint64) bool {
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) & l.mask
+		if atomic.LoadUint64(&l.bits[pos/64])&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds a key to the filter.
+func (bf *bloomFilter) add(key []byte) {
+	h1, h2 := bloomHash(key)
+
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	layers := bf.layers.Load().([]*bloomLayer)
+	last := layers[len(layers)-1]
+	if bf.count >= last.capacity {
+		total := 0
+		for _, l := range layers {
+			total += l.capacity
+		}
+		last = newBloomLayer(total * bloomGrowthFactor)
+		newLayers := make([]*bloomLayer, len(layers), len(layers)+1)
+		copy(newLayers, layers)
+		bf.layers.Store(append(newLayers, last))
+		bf.count = 0
+	}
+	last.add(h1, h2)
+	bf.count++
+}
+
+// addDoubleHashCode registers a hashing function used by double-hash rules,
+// so that lookups double-hash with it.
+func (bf *bloomFilter) addDoubleHashCode(code uint64) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	codes := bf.codes.Load().([]uint64)
+	for _, c := range codes {
+		if c == code {
+			return
+		}
+	}
+	newCodes := make([]uint64, len(codes), len(codes)+1)
+	copy(newCodes, codes)
+	bf.codes.Store(append(newCodes, code))
+}
+
+// has returns false when the key was never added to the filter. True means
+// that it may have been.
+func (bf *bloomFilter) has(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	for _, l := range bf.layers.Load().([]*bloomLayer) {
+		if l.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayBlockCid returns false when no IPFS or double-hash rule can match the
+// given CID. It computes the same keys as Denylist.IsCidBlocked, only once
+// for all denylists, and leaves the double-hashes in lh for them. Errors are
+// left for the denylists to report.
+func (bf *bloomFilter) mayBlockCid(c cid.Cid, legacyDoubleHash bool, lh *lookupHashes) bool {
+	var keyBuf [keyBufferSize]byte
+	mh := cidMultihash(keyBuf[:0], c)
+	if bf.has(mh) {
+		return true
+	}
+
+	codes := bf.codes.Load().([]uint64)
+	if len(codes) == 0 {
+		return false
+	}
+
+	if legacyDoubleHash {
+		for _, code := range codes {
+			if code != multihash.SHA2_256 {
+				continue
+			}
+			setCidLegacyInput(lh, c, mh)
+			dh, _ := lh.doubleHash(inputLegacy, multihash.SHA2_256)
+			if bf.has(dh) {
+				return true
+			}
+		}
+	}
+
+	setCidModernInput(lh, mh)
+	for _, code := range codes {
+		dh, err := lh.doubleHash(inputModern, code)
+		if err != nil || bf.has(dh) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package nopfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+func bloomTestKey(i int) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(i))
+	sum := sha256.Sum256(buf[:])
+	mh, _ := multihash.Encode(sum[:], multihash.SHA2_256)
+	return mh
+}
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter()
+
+	// Enough keys to need several layers.
+	n := bloomMinCapacity * 2
+	for i := 0; i < n; i++ {
+		bf.add(bloomTestKey(i))
+	}
+	if layers := len(bf.layers.Load().([]*bloomLayer)); layers < 2 {
+		t.Fatalf("expected the filter to grow, got %d layers", layers)
+	}
+
+	for i := 0; i < n; i++ {
+		if !bf.has(bloomTestKey(i)) {
+			t.Fatalf("key %d was added but not found", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := n; i < 2*n; i++ {
+		if bf.has(bloomTestKey(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(n); rate > 0.03 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+}
+
+func TestBlockerBloomFilter(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.deny")
+	legacy := sha256.Sum256([]byte(cid.NewCidV1(cid.DagProtobuf, testCid2.Hash()).String() + "/"))
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid1.String()+"\n//"+hex.EncodeToString(legacy[:])+"\n")
+
+	// Twice, so that the second time rules are loaded from a snapshot.
+	for i := 0; i < 2; i++ {
+		blocker, err := NewBlocker([]string{fpath}, WithSnapshots(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && blocker.denylists[0].snapshot == nil {
+			t.Fatal("expected the snapshot to be used")
+		}
+
+		// Followed denylists are loaded in the background.
+		for _, c := range []cid.Cid{testCid1, testCid2} {
+			c := c
+			waitForStatus(t, StatusBlocked, func() StatusResponse {
+				return blocker.IsCidBlocked(c)
+			})
+		}
+		if resp := blocker.IsCidBlocked(testCid3); resp.Status != StatusNotFound {
+			t.Errorf("%s should not be blocked: %s", testCid3, resp)
+		}
+
+		// Rules appended to followed denylists are added to the
+		// filter.
+		f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mh, err := multihash.Sum([]byte(testCid3.Hash().B58String()), multihash.BLAKE3, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("//" + mh.B58String() + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		waitForStatus(t, StatusBlocked, func() StatusResponse {
+			return blocker.IsCidBlocked(testCid3)
+		})
+
+		blocker.Close()
+		if i == 0 {
+			// Restore the denylist and write its snapshot for the
+			// next round.
+			writeTestDenylist(t, fpath, "/ipfs/"+testCid1.String()+"\n//"+hex.EncodeToString(legacy[:])+"\n")
+			dl, err := NewDenylist(fpath, false, WithSnapshots(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dl.Close()
+		}
+	}
+}
+
+// BenchmarkBlockerIsCidBlocked looks up CIDs that are not blocked in a
+// blocker with a badbits-sized denylist (legacy double-hashes).
+func BenchmarkBlockerIsCidBlocked(b *testing.B) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(b.TempDir(), "badbits.deny")
+	f, err := os.Create(fpath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString("hints:\n  double_hash_enc: hex\n---\n")
+	for i := 0; i < 500000; i++ {
+		sum := sha256.Sum256(bloomTestKey(i))
+		w.WriteString("//" + hex.EncodeToString(sum[:]) + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	cids := make([]cid.Cid, 1024)
+	for i := range cids {
+		cids[i] = cid.NewCidV1(cid.Raw, bloomTestKey(-i-1))
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"bloom filter", nil},
+		{"no bloom filter", []Option{WithBloomFilter(false)}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			blocker, err := NewBlocker([]string{fpath}, append(tc.opts, WithFollow(false))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer blocker.Close()
+			runtime.GC()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if resp := blocker.IsCidBlocked(cids[i%len(cids)]); resp.Status != StatusNotFound {
+					b.Fatal(resp)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package nopfs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupCache is a bounded LRU cache of the StatusResponses of a Blocker.
+//
+// Rather than clearing it, the cache is invalidated by bumping a
+// generation number, which is cheap enough to do for every rule that a
+// denylist ingests: entries from older generations are misses and are
+// dropped when found (or evicted). Lookups only store their results when
+// the generation has not changed since they started, so results computed
+// with old rules are never cached.
+//
+// Responses can also change with time, as rules with not_before and expires
+// hints become active or inactive. The earliest time at which a rule seen
+// by lookups changes is tracked and the cache is invalidated when reached.
+type lookupCache struct {
+	// Accessed atomically. First in the struct for alignment.
+	generation uint64
+	hits       uint64
+	misses     uint64
+	deadline   int64 // unix nanoseconds, 0 for none
+
+	clock func() time.Time
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *cacheEntry, most recent first
+	entries map[cacheKey]*list.Element
+}
+
+// cacheKey identifies a lookup: a CID (by its binary form) or a path.
+type cacheKey struct {
+	kind byte // 'c' or 'p'
+	key  string
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	generation uint64
+	resp       StatusResponse
+}
+
+// CacheStats contains the counters of the lookup cache of a Blocker (see
+// WithCache).
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+func newLookupCache(size int, clock func() time.Time) *lookupCache {
+	return &lookupCache{
+		clock:   clock,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element, size),
+	}
+}
+
+// currentGeneration returns the generation of the cache, invalidating it
+// first if its deadline has passed. Responses computed from indexes obtained
+// afterwards can be cached with it.
+func (c *lookupCache) currentGeneration() uint64 {
+	if deadline := atomic.LoadInt64(&c.deadline); deadline != 0 && c.clock().UnixNano() >= deadline {
+		if atomic.CompareAndSwapInt64(&c.deadline, deadline, 0) {
+			atomic.AddUint64(&c.generation, 1)
+		}
+	}
+	return atomic.LoadUint64(&c.generation)
+}
+
+// get returns the cached response for a key, if any, along with the
+// generation to pass to put() when there is none.
+func (c *lookupCache) get(key cacheKey) (StatusResponse, uint64, bool) {
+	gen := c.currentGeneration()
+
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		ce := elem.Value.(*cacheEntry)
+		if ce.generation == gen {
+			c.lru.MoveToFront(elem)
+			resp := ce.resp
+			c.mu.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return resp, gen, true
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+	return StatusResponse{}, gen, false
+}
+
+// put caches the response for a key, unless the cache has been invalidated
+// since the given generation was obtained from get().
+func (c *lookupCache) put(key cacheKey, gen uint64, resp StatusResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadUint64(&c.generation) != gen {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		ce := elem.Value.(*cacheEntry)
+		ce.generation = gen
+		ce.resp = resp
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	var ce *cacheEntry
+	if c.lru.Len() >= c.size {
+		// Reuse the least recently used entry.
+		oldest := c.lru.Back()
+		ce = c.lru.Remove(oldest).(*cacheEntry)
+		delete(c.entries, ce.key)
+	} else {
+		ce = &cacheEntry{}
+	}
+	*ce = cacheEntry{key: key, generation: gen, resp: resp}
+	c.entries[key] = c.lru.PushFront(ce)
+}
+
+// invalidate makes all the cached responses stale. It can be called on a
+// nil cache.
+func (c *lookupCache) invalidate() {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.generation, 1)
+}
+
+// invalidateAt makes the cached responses stale from the given time on
+// (which is ignored when zero). It can be called on a nil cache.
+func (c *lookupCache) invalidateAt(t time.Time) {
+	if c == nil || t.IsZero() {
+		return
+	}
+	ns := t.UnixNano()
+	for {
+		deadline := atomic.LoadInt64(&c.deadline)
+		if deadline != 0 && deadline <= ns {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&c.deadline, deadline, ns) {
+			return
+		}
+	}
+}
+
+func (c *lookupCache) stats() CacheStats {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: n,
+	}
+}
@@ -22,6 +22,7 @@ func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("> c <cid>")
 	fmt.Println("> p <path>")
+	fmt.Println("> e <cid or path> (explain)")
 }
 
 func main() {
@@ -79,10 +80,22 @@ func main() {
 				status := blocker.IsCidBlocked(c)
 				fmt.Println(status)
 			}
+		case "e":
+			var exp nopfs.Explanation
+			if c, err := cid.Decode(elem); err == nil {
+				exp = blocker.ExplainCid(c)
+			} else if p, err := path.NewPath(elem); err == nil {
+				exp = blocker.ExplainPath(p)
+			} else {
+				fmt.Printf("error parsing cid or path: %s\n", err)
+				break
+			}
+			for _, m := range exp.Matches {
+				fmt.Printf("  %s\n", m)
+			}
+			fmt.Println(exp.Reason)
 		default:
-			fmt.Println("Usage:")
-			fmt.Println("> c <cid>")
-			fmt.Println("> p <path>")
+			printUsage()
 		}
 		printPrompt()
 
@@ -2,18 +2,24 @@ package nopfs
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/ipfs/boxo/path"
 	"github.com/ipfs/go-cid"
-	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	mhreg "github.com/multiformats/go-multihash/core"
@@ -24,6 +30,41 @@ import (
 // ErrHeaderNotFound is returned when no header can be Decoded.
 var ErrHeaderNotFound = errors.New("header not found")
 
+// Well-known hints with special meaning for nopfs.
+const (
+	// HintPriority can be set in the header of a denylist to an integer
+	// to specify the precedence of the denylist in a Blocker (higher
+	// goes first). Defaults to 0.
+	HintPriority = "priority"
+	// HintGatewayStatus can be set in the header of a denylist or in a
+	// rule to the HTTP status code that gateways should return for
+	// blocked content (i.e. 410 or 451). See StatusResponse.HTTPStatus().
+	HintGatewayStatus = "gateway_status"
+	// HintDoubleHashFn can be set in the header of a denylist or in a
+	// rule to the name of the hashing function used by double-hash rules
+	// (i.e. sha256 or blake3).
+	HintDoubleHashFn = "double_hash_fn"
+	// HintDoubleHashEnc can be set in the header of a denylist or in a
+	// rule to the encoding used by double-hash rules: "hex" for
+	// hex-encoded digests (sha256 unless double_hash_fn says otherwise)
+	// or "b58" for base58btc-encoded multihashes. When not set, both are
+	// attempted, which may result in two index entries per rule.
+	HintDoubleHashEnc = "double_hash_enc"
+	// HintExpires can be set in the header of a denylist or in a rule
+	// to an RFC3339 timestamp after which rules no longer apply. Expired
+	// rules are eventually removed from memory.
+	HintExpires = "expires"
+	// HintNotBefore can be set in the header of a denylist or in a rule
+	// to an RFC3339 timestamp before which rules do not apply yet.
+	HintNotBefore = "not_before"
+	// HintCategory can be set in the header of a denylist or in a rule
+	// to the category of the blocked content (i.e. malware or
+	// phishing). Several comma-separated categories can be
+	// given. Lookups can ignore rules by category (see
+	// WithEnabledCategories and WithDisabledCategories).
+	HintCategory = "category"
+)
+
 const maxHeaderSize = 1 << 20 // 1MiB per the spec
 const maxLineSize = 2 << 20   // 2MiB per the spec
 const currentVersion = 1
@@ -85,19 +126,25 @@ func (h *DenylistHeader) Decode(r io.Reader) error {
 
 	err := yaml.Unmarshal(h.headerBytes, h)
 	if err != nil {
-		logger.Error(err)
 		return err
 	}
 
 	// In the future this may need adapting to support several versions.
 	if h.Version > 0 && h.Version != currentVersion {
-		err = errors.New("unsupported denylist version")
-		logger.Error(err)
-		return err
+		return errors.New("unsupported denylist version")
 	}
 	return nil
 }
 
+// size returns the number of bytes taken by the header in the denylist file,
+// including the "---" separator line. It is 0 when no header was found.
+func (h DenylistHeader) size() int64 {
+	if h.headerLines == 0 {
+		return 0
+	}
+	return int64(len(h.headerBytes) + 4)
+}
+
 // String provides a short string summary of the Header.
 func (h DenylistHeader) String() string {
 	return fmt.Sprintf("%s (%s) by %s", h.Name, h.Description, h.Author)
@@ -110,60 +157,302 @@ type Denylist struct {
 	Header   DenylistHeader
 	Filename string
 
+	// Entries contains the rules parsed from the file. It is not
+	// populated when a BlocksDBFactory is set with WithBlocksDB, as
+	// that would defeat the purpose of storing rules elsewhere.
 	Entries Entries
 
-	IPFSBlocksDB       *BlocksDB
-	IPNSBlocksDB       *BlocksDB
-	DoubleHashBlocksDB map[uint64]*BlocksDB // mhCode -> blocks using that code
-	PathBlocksDB       *BlocksDB
-	PathPrefixBlocks   Entries
+	// The indexes below are replaced, never modified, when they change
+	// (i.e. DoubleHashBlocksDB when a new hashing function is used, all
+	// of them on reloads). Lookups do not use these fields but the
+	// latest published set of indexes (see denylistIndexes).
+	IPFSBlocksDB       BlocksDB
+	IPNSBlocksDB       BlocksDB
+	DoubleHashBlocksDB map[uint64]BlocksDB // mhCode -> blocks using that code
+	PathBlocksDB       BlocksDB
 	// MimeBlocksDB
 
+	// pathPatternBlocks indexes path rules with prefixes or
+	// wildcards. Every path request would have to loop them otherwise.
+	pathPatternBlocks *pathIndex
+
+	// indexes is the *denylistIndexes used by lookups.
+	indexes atomic.Value
+
+	// nextExpiry is the earliest expiration time among the rules (unix
+	// nanoseconds, accessed atomically), used to trigger the removal of
+	// expired rules (zero when none expire). expiries holds the distinct
+	// expiration times of the rules, in unix nanoseconds.
+	nextExpiry int64
+	expiries   map[int64]struct{}
+	evicting   int32
+
+	// snapshot, when loaded, holds the rules for the part of the file
+	// it covers. snapshotWriter collects rules to write one.
+	snapshot       *snapshot
+	snapshotWriter *snapshotWriter
+
+	cfg config
+	// skip is dl.skipEntry, kept to avoid allocating a method value
+	// on every lookup.
+	skip func(Entry) bool
+
+	// loading is set while the rules in the file when it is opened are
+	// loaded, until EventDenylistLoaded is sent. It is only used by the
+	// goroutine reading the file.
+	loading bool
+
+	// allowlist is set for ".allow" files, whose rules are all allow
+	// rules (see IsAllowlist).
+	allowlist bool
+
+	// mu serializes changes to the Header and the indexes above. It is
+	// not used by lookups.
+	mu      sync.RWMutex
+	closed  bool
 	f       io.ReadSeekCloser
 	watcher *fsnotify.Watcher
 }
 
+// denylistIndexes is a set of indexes of a Denylist, as used by lookups.
+//
+// Lookups do not take the Denylist lock. Instead, they use the latest
+// published set, which is not modified: when indexes are added or
+// replaced (a double-hash index for a new hashing function, a snapshot,
+// a reload...), a new set is published. The indexes themselves support
+// storing rules while they are read, so new rules are visible to lookups
+// as soon as they are stored.
+//
+// Sets that are no longer published are retired: the resources that only
+// they use (i.e. the indexes replaced on reloads) are released once the
+// lookups using them finish.
+type denylistIndexes struct {
+	// readers is the number of lookups using the set, accessed
+	// atomically. First in the struct for alignment.
+	readers int64
+	// retired is set (atomically) once the set is no longer
+	// published, so that the last lookup using it signals cond.
+	retired int32
+	mu      sync.Mutex
+	cond    sync.Cond
+
+	ipfs       BlocksDB
+	ipns       BlocksDB
+	path       BlocksDB
+	doubleHash map[uint64]BlocksDB
+	patterns   *pathIndex
+	snapshot   *snapshot
+}
+
+// waitReaders returns when no lookups use the set. It must no longer be
+// published.
+func (idx *denylistIndexes) waitReaders() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	atomic.StoreInt32(&idx.retired, 1)
+	for atomic.LoadInt64(&idx.readers) > 0 {
+		idx.cond.Wait()
+	}
+}
+
+// publish makes lookups use the current indexes of the Denylist. It
+// returns the set that was in use before, if any. Nothing is published once
+// the Denylist is closed. The caller must hold the lock.
+func (dl *Denylist) publish() *denylistIndexes {
+	if dl.closed {
+		return nil
+	}
+	return dl.publishIndexes(&denylistIndexes{
+		ipfs:       dl.IPFSBlocksDB,
+		ipns:       dl.IPNSBlocksDB,
+		path:       dl.PathBlocksDB,
+		doubleHash: dl.DoubleHashBlocksDB,
+		patterns:   dl.pathPatternBlocks,
+		snapshot:   dl.snapshot,
+	})
+}
+
+// publishIndexes makes lookups use the given set and returns the set that
+// was in use before, if any.
+func (dl *Denylist) publishIndexes(idx *denylistIndexes) *denylistIndexes {
+	old, _ := dl.indexes.Load().(*denylistIndexes)
+	idx.cond.L = &idx.mu
+	dl.indexes.Store(idx)
+	return old
+}
+
+// acquireIndexes returns the indexes to use for a lookup. They must be
+// released with releaseIndexes.
+func (dl *Denylist) acquireIndexes() *denylistIndexes {
+	for {
+		idx := dl.indexes.Load().(*denylistIndexes)
+		atomic.AddInt64(&idx.readers, 1)
+		// A set retired in the meantime may be released without
+		// waiting for us.
+		if dl.indexes.Load().(*denylistIndexes) == idx {
+			return idx
+		}
+		dl.releaseIndexes(idx)
+	}
+}
+
+func (dl *Denylist) releaseIndexes(idx *denylistIndexes) {
+	if atomic.AddInt64(&idx.readers, -1) == 0 && atomic.LoadInt32(&idx.retired) == 1 {
+		// Taking the lock ensures waitReaders is waiting
+		// already, or will see no readers.
+		idx.mu.Lock()
+		idx.cond.Broadcast()
+		idx.mu.Unlock()
+	}
+}
+
+// blocksDB returns the BlocksDB for the given index, if any.
+func (idx *denylistIndexes) blocksDB(kind indexKind, mhCode uint64) BlocksDB {
+	switch kind {
+	case indexIPFS:
+		return idx.ipfs
+	case indexIPNS:
+		return idx.ipns
+	case indexPath:
+		return idx.path
+	case indexDoubleHash:
+		return idx.doubleHash[mhCode]
+	}
+	return nil
+}
+
 // NewDenylist opens a denylist file and processes it (parses all its entries).
 //
 // If follow is false, the file handle is closed.
 //
 // If follow is true, the denylist file will be followed upon return. Any
-// appended rules will be processed live-updated in the
-// denylist. Denylist.Close() should be used when the Denylist or the
-// following is no longer needed.
-func NewDenylist(filepath string, follow bool) (*Denylist, error) {
+// appended rules will be processed live-updated in the denylist. When the
+// file is modified in other ways (truncated, rewritten or replaced), the
+// denylist is fully re-parsed and the new rules replace the old ones once
+// ready. Denylist.Close() should be used when the Denylist or the following
+// is no longer needed.
+//
+// Options can be used to customize the Denylist (the WithFollow option is
+// ignored in favor of the follow parameter).
+func NewDenylist(filepath string, follow bool, opts ...Option) (*Denylist, error) {
+	return openDenylist(filepath, follow, newConfig(opts))
+}
+
+func openDenylist(filepath string, follow bool, cfg config) (*Denylist, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	dl := Denylist{
-		Filename:           filepath,
-		f:                  f,
-		IPFSBlocksDB:       &BlocksDB{},
-		IPNSBlocksDB:       &BlocksDB{},
-		PathBlocksDB:       &BlocksDB{},
-		DoubleHashBlocksDB: make(map[uint64]*BlocksDB),
+	dl, err := newDenylist(filepath, f, cfg)
+	if err != nil {
+		return nil, err
 	}
-
 	err = dl.parseAndFollow(follow)
-	return &dl, err
+	return dl, err
 }
 
 // NewDenylistReader processes a denylist from the given reader (parses all
 // its entries).
-func NewDenylistReader(r io.ReadSeekCloser) (*Denylist, error) {
-	dl := Denylist{
-		Filename:           "",
-		f:                  r,
-		IPFSBlocksDB:       &BlocksDB{},
-		IPNSBlocksDB:       &BlocksDB{},
-		PathBlocksDB:       &BlocksDB{},
-		DoubleHashBlocksDB: make(map[uint64]*BlocksDB),
+func NewDenylistReader(r io.ReadSeekCloser, opts ...Option) (*Denylist, error) {
+	return openDenylistReader("", r, newConfig(opts))
+}
+
+// openDenylistReader processes a denylist from a reader, using name as its
+// Filename. Snapshots, which are written next to denylist files, are not
+// used.
+func openDenylistReader(name string, r io.ReadSeekCloser, cfg config) (*Denylist, error) {
+	cfg.snapshots = false
+	dl, err := newDenylist(name, r, cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = dl.parseAndFollow(false)
+	return dl, err
+}
+
+// newDenylist returns a Denylist with empty indexes. The file is closed on
+// error.
+func newDenylist(filename string, f io.ReadSeekCloser, cfg config) (*Denylist, error) {
+	dl := &Denylist{
+		Filename:           filename,
+		f:                  f,
+		cfg:                cfg,
+		DoubleHashBlocksDB: make(map[uint64]BlocksDB),
+		pathPatternBlocks:  newPathIndex(),
+		allowlist:          isAllowlistFile(filename),
+	}
+	dl.skip = dl.skipEntry
+
+	var err error
+	for _, db := range []struct {
+		index string
+		db    *BlocksDB
+	}{
+		{"ipfs", &dl.IPFSBlocksDB},
+		{"ipns", &dl.IPNSBlocksDB},
+		{"path", &dl.PathBlocksDB},
+	} {
+		*db.db, err = dl.newBlocksDB(db.index)
+		if err != nil {
+			dl.Close()
+			return nil, err
+		}
+	}
+	dl.publish()
+	return dl, nil
+}
+
+func (dl *Denylist) newBlocksDB(index string) (BlocksDB, error) {
+	if dl.cfg.blocksDBFactory == nil {
+		return &MemoryBlocksDB{}, nil
+	}
+	db, err := dl.cfg.blocksDBFactory(dl.Filename, index)
+	if err != nil {
+		return nil, err
+	}
+	if ddb, ok := db.(*DiskBlocksDB); ok {
+		ddb.logger = dl.cfg.logger
 	}
+	return db, nil
+}
 
-	err := dl.parseAndFollow(false)
-	return &dl, err
+// doubleHashBlocksDB returns the BlocksDB for double-hashes using the given
+// multihash code, creating it if needed. The caller must hold the lock.
+func (dl *Denylist) doubleHashBlocksDB(mhCode uint64) (BlocksDB, error) {
+	if db, ok := dl.DoubleHashBlocksDB[mhCode]; ok {
+		return db, nil
+	}
+	db, err := dl.newBlocksDB(fmt.Sprintf("double-hash-%d", mhCode))
+	if err != nil {
+		return nil, err
+	}
+	// Lookups may be iterating the current map.
+	dbs := make(map[uint64]BlocksDB, len(dl.DoubleHashBlocksDB)+1)
+	for code, db := range dl.DoubleHashBlocksDB {
+		dbs[code] = db
+	}
+	dbs[mhCode] = db
+	dl.DoubleHashBlocksDB = dbs
+	dl.publish()
+	if dl.cfg.bloom != nil {
+		dl.cfg.bloom.addDoubleHashCode(mhCode)
+	}
+	return db, nil
+}
+
+// blocksDBs returns all the BlocksDBs of the Denylist.
+func (dl *Denylist) blocksDBs() []BlocksDB {
+	var dbs []BlocksDB
+	for _, db := range []BlocksDB{dl.IPFSBlocksDB, dl.IPNSBlocksDB, dl.PathBlocksDB} {
+		if db != nil {
+			dbs = append(dbs, db)
+		}
+	}
+	for _, db := range dl.DoubleHashBlocksDB {
+		dbs = append(dbs, db)
+	}
+	return dbs
 }
 
 // read the header and make sure the reader is in the right position for
@@ -178,22 +467,23 @@ func (dl *Denylist) readHeader() error {
 		// reset the reader
 		_, err = dl.f.Seek(0, 0)
 		if err != nil {
-			logger.Error(err)
+			dl.cfg.logger.Error(err)
 			return err
 		}
-		logger.Warnf("Opening %s: empty header", dl.Filename)
-		logger.Infof("Processing %s: %s", dl.Filename, dl.Header)
+		dl.cfg.logger.Warnf("Opening %s: empty header", dl.Filename)
+		dl.cfg.logger.Infof("Processing %s: %s", dl.Filename, dl.Header)
 		return nil
 	} else if err != nil {
+		dl.cfg.logger.Error(err)
 		return err
 	}
 
-	logger.Infof("Processing %s: %s", dl.Filename, dl.Header)
+	dl.cfg.logger.Infof("Processing %s: %s", dl.Filename, dl.Header)
 
 	// We have to deal with the buffered reader reading beyond the header.
 	_, err = dl.f.Seek(int64(len(dl.Header.headerBytes)+4), 0)
 	if err != nil {
-		logger.Error(err)
+		dl.cfg.logger.Error(err)
 		return err
 	}
 	// The reader should be set at the line after ---\n now.
@@ -209,29 +499,41 @@ func (dl *Denylist) parseAndFollow(follow bool) error {
 		return err
 	}
 
-	// we will update N as we go after every line.  Fixme: this is
-	// going to play weird as the buffered reader will read-ahead
-	// and consume N.
-	limRdr := &io.LimitedReader{
-		R: dl.f,
-		N: maxLineSize,
+	lr := newLineReader(dl.f, dl.Header.headerLines, dl.Header.size())
+	dl.loading = true
+	if follow || dl.cfg.snapshots {
+		lr.hashFrom(dl.Header)
+	}
+
+	if dl.cfg.snapshots && dl.Filename != "" {
+		dl.mu.Lock()
+		snapLr, err := dl.loadSnapshot()
+		if err != nil {
+			dl.cfg.logger.Infof("%s: not using snapshot: %s", dl.Filename, err)
+			dl.snapshotWriter = newSnapshotWriter()
+		} else {
+			lr = snapLr
+		}
+		dl.mu.Unlock()
 	}
-	r := bufio.NewReader(limRdr)
-	lineNumber := dl.Header.headerLines
 
 	// we finished reading the file as it EOF'ed.
 	if !follow {
-		return dl.followLines(r, limRdr, lineNumber, nil)
+		return dl.followLines(lr, nil)
 	}
 	// We now wait for new lines.
 
+	// We watch the folder containing the file rather than the file
+	// itself. This way we notice when the file is replaced (i.e. editors
+	// saving via rename, or mv new.deny list.deny) and can re-open it.
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		dl.Close()
 		return err
 	}
 	dl.watcher = watcher
-	err = watcher.Add(dl.Filename)
+	fname := filepath.Clean(dl.Filename)
+	err = watcher.Add(filepath.Dir(fname))
 	if err != nil {
 		dl.Close()
 		return err
@@ -240,117 +542,478 @@ func (dl *Denylist) parseAndFollow(follow bool) error {
 	waitForWrite := func() error {
 		for {
 			select {
-			case event := <-dl.watcher.Events:
-				if event.Op&fsnotify.Write == fsnotify.Write {
+			case event, ok := <-dl.watcher.Events:
+				if !ok {
+					return errDenylistClosed
+				}
+				if filepath.Clean(event.Name) != fname {
+					continue
+				}
+				switch {
+				case event.Op&fsnotify.Write == fsnotify.Write:
 					return nil
+				case event.Op&fsnotify.Create == fsnotify.Create:
+					// File was replaced.
+					return nil
+				case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+					// We keep the current rules until a new
+					// file appears.
+					dl.cfg.logger.Infof("%s: denylist removed or renamed. Waiting for it to re-appear.", dl.Filename)
+				}
+			case err, ok := <-dl.watcher.Errors:
+				if !ok {
+					return errDenylistClosed
 				}
-			case err := <-dl.watcher.Errors:
-				// TODO: log
 				return err
 			}
 		}
 	}
 
-	go dl.followLines(r, limRdr, lineNumber, waitForWrite)
+	// With a strict policy, we need to load the whole list before
+	// returning so that errors can be reported.
+	if dl.cfg.errorPolicy == ErrorPolicyStrict {
+		if err := dl.followLines(lr, nil); err != nil {
+			return err
+		}
+	}
+
+	go dl.followLines(lr, waitForWrite)
 	return nil
 }
 
-// followLines reads lines from a buffered reader on top of a limited reader,
-// that we reset on every line. This enforces line-length limits.
+// errDenylistClosed is used internally to signal that following stopped
+// because the Denylist was closed.
+var errDenylistClosed = errors.New("denylist closed")
+
+// lineReader reads full lines from a buffered reader on top of a limited
+// reader, that we reset on every line. This enforces line-length limits.
+//
+// It keeps track of the number of lines and bytes consumed, along with the
+// last line read and a hash of everything read, so that we can find out
+// whether the part of the file that has been processed is modified.
+type lineReader struct {
+	limRdr *io.LimitedReader
+	r      *bufio.Reader
+
+	partialLine string
+	lineNumber  uint64
+	offset      int64
+	lastLine    string
+
+	// sum, when set, hashes the file up to offset (see hashFrom). It is
+	// used to detect edits and for snapshots.
+	sum hash.Hash
+}
+
+func newLineReader(r io.Reader, lineNumber uint64, offset int64) *lineReader {
+	// we will update N as we go after every line.  Fixme: this is
+	// going to play weird as the buffered reader will read-ahead
+	// and consume N.
+	limRdr := &io.LimitedReader{
+		R: r,
+		N: maxLineSize,
+	}
+	return &lineReader{
+		limRdr:     limRdr,
+		r:          bufio.NewReader(limRdr),
+		lineNumber: lineNumber,
+		offset:     offset,
+	}
+}
+
+// readLine returns the next full line. When io.EOF is returned, any partial
+// line read is kept and completed on the next call.
+func (lr *lineReader) readLine() (string, error) {
+	partialLine, err := lr.r.ReadString('\n')
+
+	// limit reader exhausted
+	if err == io.EOF && lr.limRdr.N == 0 {
+		return "", errLineTooLong
+	}
+
+	// Record how much of a line we have
+	lr.partialLine += partialLine
+	if err != nil {
+		return "", err
+	}
+
+	// if we are here, no EOF, no error and ReadString()
+	// found an \n so we have a full line.
+	line := lr.partialLine
+	lr.partialLine = ""
+	lr.limRdr.N = maxLineSize // reset
+	lr.lineNumber++
+	lr.offset += int64(len(line))
+	lr.lastLine = line
+	if lr.sum != nil {
+		io.WriteString(lr.sum, line)
+	}
+	return line, nil
+}
+
+// hashFrom starts hashing the file read by a new lineReader, positioned right
+// after the given header, so that we can tell whether the part of the file
+// already read is edited, and snapshots can record a hash of the part of the
+// file they cover.
+func (lr *lineReader) hashFrom(header DenylistHeader) {
+	lr.sum = sha256.New()
+	if header.headerLines > 0 {
+		lr.sum.Write(header.headerBytes)
+		io.WriteString(lr.sum, "---\n")
+	}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// followLines reads lines using the given lineReader and parses them.
+// The lines available when called are parsed in parallel (see loadLines).
 // If we pass a waitWrite() function, then it waits when finding EOF.
 //
-// Is this the right way of tailing a file? Pretty sure there are a
-// bunch of gotchas. It seems to work when saving on top of a file
-// though. Also, important that the limitedReader is there to avoid
-// parsing a huge lines.  Also, this could be done by just having
-// watchers on the folder, but requires a small refactoring.
-func (dl *Denylist) followLines(r *bufio.Reader, limRdr *io.LimitedReader, lineNumber uint64, waitWrite func() error) error {
-	line := ""
-	limRdr.N = maxLineSize // reset
+// When waitWrite() returns, we check whether the file was appended to or
+// modified otherwise (rewritten, truncated, replaced...). In the latter case
+// the whole denylist is reloaded. Important that the limitedReader is there
+// to avoid parsing a huge lines.
+func (dl *Denylist) followLines(lr *lineReader, waitWrite func() error) error {
+	// With a strict policy, errors while loading are fatal, but not
+	// in lines appended while following.
+	strict := waitWrite == nil && dl.cfg.errorPolicy == ErrorPolicyStrict
+	if err := dl.loadLines(lr, strict); err != nil {
+		return err
+	}
 
 	for {
-		partialLine, err := r.ReadString('\n')
+		line, err := lr.readLine()
 
-		// limit reader exhausted
-		if err == io.EOF && limRdr.N == 0 {
-			err = fmt.Errorf("line too long. %s:%d", dl.Filename, lineNumber+1)
-			logger.Error(err)
+		if err == errLineTooLong {
+			err = fmt.Errorf("line too long. %s:%d", dl.Filename, lr.lineNumber+1)
+			dl.cfg.logger.Error(err)
 			dl.Close()
 			return err
 		}
 
-		// Record how much of a line we have
-		line += partialLine
-
 		if err == io.EOF {
-			if waitWrite != nil { // keep waiting
-				err := waitWrite()
+			dl.writeSnapshot(lr)
+			if dl.loading {
+				dl.loading = false
+				dl.cfg.events.emit(Event{Type: EventDenylistLoaded, Filename: dl.Filename})
+			}
+			if waitWrite == nil { // Finished
+				return nil
+			}
+			// keep waiting
+			err := waitWrite()
+			if err == errDenylistClosed {
+				return nil
+			}
+			if err != nil {
+				dl.cfg.logger.Error(err)
+				dl.Close()
+				return err
+			}
+
+			modified, err := dl.modified(lr)
+			if err != nil {
+				dl.cfg.logger.Error(err)
+				continue
+			}
+			if modified {
+				dl.cfg.logger.Infof("%s: denylist modified. Reloading.", dl.Filename)
+				newLr, err := dl.reload()
+				if err == errDenylistClosed {
+					return nil
+				}
 				if err != nil {
-					logger.Error(err)
-					dl.Close()
-					return err
+					dl.cfg.logger.Errorf("error reloading %s: %s", dl.Filename, err)
+					continue
 				}
-				continue
-			} else { // Finished
-				return nil
+				lr = newLr
 			}
+			continue
 		}
 		if err != nil {
-			logger.Error(err)
+			dl.cfg.logger.Error(err)
 			dl.Close()
 			return err
 		}
 
-		// if we are here, no EOF, no error and ReadString()
-		// found an \n so we have a full line.
-
-		lineNumber++
 		// we have read up to \n
-		if err := dl.parseLine(line, lineNumber); err != nil {
-			logger.Error(err)
+		dl.mu.Lock()
+		e, added, err := dl.parseLine(line, lr.lineNumber)
+		dl.mu.Unlock()
+		if err != nil {
+			if strict {
+				dl.Close()
+				return err
+			}
+			dl.cfg.logger.Error(err)
+			dl.cfg.events.emit(Event{Type: EventParseError, Filename: dl.Filename, Err: err})
 			// log error and continue with next line
+			continue
+		}
+		// Rules in the file when it was loaded are not announced
+		// one by one, nor those of reloads (when waitWrite is nil).
+		if added && !dl.loading && waitWrite != nil {
+			dl.cfg.events.emit(Event{Type: EventRuleAdded, Filename: dl.Filename, Entry: e})
+		}
+	}
+}
+
+// modified returns true when the part of the denylist file that has already
+// been processed has changed. This happens when the file is replaced by a
+// different one, it is truncated, the header changes, the last processed
+// line is no longer where it was or any other processed line is edited.
+// Appending to the file does not count as a modification.
+//
+// Edits that keep the size of the file are only found by hashing the
+// processed part again, which reads the whole file on every write.
+func (dl *Denylist) modified(lr *lineReader) (bool, error) {
+	dl.mu.RLock()
+	f, ok := dl.f.(*os.File)
+	header := dl.Header
+	dl.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	fi, err := os.Stat(dl.Filename)
+	if err != nil {
+		return false, err
+	}
+	openFi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if !os.SameFile(fi, openFi) {
+		return true, nil
+	}
+	changed, err := sourceChanged(f, header, lr.offset, lr.lastLine)
+	if err != nil || changed || lr.sum == nil {
+		return changed, err
+	}
+	sum, err := sumFile(f, lr.offset)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(sum.Sum(nil), lr.sum.Sum(nil)), nil
+}
+
+// sourceChanged returns true when the first offset bytes of the file, with
+// the given header and lastLine at the end, have changed.
+func sourceChanged(f *os.File, header DenylistHeader, offset int64, lastLine string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() < offset {
+		return true, nil
+	}
 
+	sameBytes := func(expected []byte, off int64) (bool, error) {
+		buf := make([]byte, len(expected))
+		_, err := f.ReadAt(buf, off)
+		if err != nil {
+			return false, err
 		}
-		// reset for next line
-		line = ""
-		limRdr.N = maxLineSize // reset
+		return bytes.Equal(buf, expected), nil
 	}
+
+	if header.headerLines > 0 {
+		headerBytes := append(header.headerBytes[:len(header.headerBytes):len(header.headerBytes)], "---\n"...)
+		same, err := sameBytes(headerBytes, 0)
+		if err != nil || !same {
+			return !same, err
+		}
+	} else if offset <= maxHeaderSize {
+		// We may have read the file while a header was being
+		// written. Check if there is one now.
+		var h DenylistHeader
+		if err := h.Decode(io.NewSectionReader(f, 0, maxHeaderSize)); err != ErrHeaderNotFound {
+			return true, nil
+		}
+	}
+
+	if len(lastLine) > 0 {
+		same, err := sameBytes([]byte(lastLine), offset-int64(len(lastLine)))
+		if err != nil || !same {
+			return !same, err
+		}
+	}
+	return false, nil
+}
+
+// sumFile returns a sha256 hash of the first n bytes of the file, which can
+// be used to continue hashing from there.
+func sumFile(f *os.File, n int64) (hash.Hash, error) {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(f, 0, n)); err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// reload parses the denylist file from scratch into new indexes and swaps
+// them with the current ones when done. Lookups keep using the old rules
+// until then. It returns a lineReader to continue following the file.
+func (dl *Denylist) reload() (*lineReader, error) {
+	f, err := os.Open(dl.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh, err := newDenylist(dl.Filename, f, dl.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if dl.cfg.snapshots {
+		fresh.snapshotWriter = newSnapshotWriter()
+	}
+
+	if err := fresh.readHeader(); err != nil {
+		fresh.Close()
+		return nil, err
+	}
+	lr := newLineReader(f, fresh.Header.headerLines, fresh.Header.size())
+	lr.hashFrom(fresh.Header)
+	// followLines closes fresh (and thus f) on error.
+	if err := fresh.followLines(lr, nil); err != nil {
+		return nil, err
+	}
+
+	dl.mu.Lock()
+	if dl.closed {
+		dl.mu.Unlock()
+		fresh.Close()
+		return nil, errDenylistClosed
+	}
+	oldF := dl.f
+	oldDBs := dl.blocksDBs()
+	oldSnapshot := dl.snapshot
+	dl.snapshot = nil
+	dl.snapshotWriter = fresh.snapshotWriter
+	dl.Header = fresh.Header
+	dl.Entries = fresh.Entries
+	dl.IPFSBlocksDB = fresh.IPFSBlocksDB
+	dl.IPNSBlocksDB = fresh.IPNSBlocksDB
+	dl.DoubleHashBlocksDB = fresh.DoubleHashBlocksDB
+	dl.PathBlocksDB = fresh.PathBlocksDB
+	dl.pathPatternBlocks = fresh.pathPatternBlocks
+	atomic.StoreInt64(&dl.nextExpiry, atomic.LoadInt64(&fresh.nextExpiry))
+	dl.expiries = fresh.expiries
+	dl.f = f
+	old := dl.publish()
+	dl.cfg.cache.invalidate()
+	dl.mu.Unlock()
+
+	old.waitReaders()
+	if oldF != nil {
+		oldF.Close()
+	}
+	if oldSnapshot != nil {
+		oldSnapshot.close()
+	}
+	for _, db := range oldDBs {
+		db.Close()
+	}
+
+	dl.cfg.logger.Infof("Reloaded %s: %s", dl.Filename, fresh.Header)
+	dl.cfg.events.emit(Event{Type: EventDenylistReloaded, Filename: dl.Filename})
+	return lr, nil
 }
 
 // parseLine processes every full-line read and puts it into the BlocksDB etc.
-// so that things can be queried later. It turns lines into Entry objects.
-//
-// Note (hector): I'm using B58Encoded-multihash strings as keys for IPFS,
-// DoubleHash BlocksDB. Why? We could be using the multihash bytes directly.
-// Some reasons (this should be changed if there are better reasons to do so):
-//
-//   - B58Encoded-strings produce readable keys. These will be readable keys
-//     in a database, readable keys in the debug logs etc. Having readable
-//     multihashes instead of raw bytes is nice.
+// so that things can be queried later. It turns lines into Entry objects
+// (see parseEntry).
 //
-//   - If we assume IPFS mostly deals in CIDv0s (raw multihashes), we can
-//     avoid parsing the Qmxxx multihash in /ipfs/Qmxxx/path and just use the
-//     string directly for lookups.
+// IPFS, IPNS (for keys) and double-hash BlocksDBs are keyed by raw multihash
+// bytes rather than by b58-encoded multihashes: lookups for CIDs and
+// double-hashes then do not need to b58-encode anything, which is most of
+// their cost otherwise, and keys are smaller. Decoding the CIDv0 in
+// /ipfs/Qmxxx/path lookups is cheaper than that. Debug logs print keys
+// b58-encoded.
 //
-//   - If we used raw bytes, we would have to decode every cidV0, but we would
-//     not have to b58-encode multihashes for lookups. Chances that this is
-//     better but well (decide before going with permanent storage!).
-func (dl *Denylist) parseLine(line string, number uint64) error {
+// It returns the Entry and whether it was added to the indexes (lines that
+// are not rules are not).
+func (dl *Denylist) parseLine(line string, number uint64) (Entry, bool, error) {
+	e, indexed, err := dl.parseEntry(line, number, dl.Header.Hints)
+	if err != nil || len(indexed) == 0 {
+		return e, false, err
+	}
+	if err := dl.addEntry(e, indexed); err != nil {
+		return e, false, err
+	}
+	return e, true, nil
+}
+
+// addEntry stores a parsed Entry in the indexes given by parseEntry. The
+// caller must hold the lock.
+func (dl *Denylist) addEntry(e Entry, indexed []indexedEntry) error {
+	for _, ie := range indexed {
+		if err := dl.storeEntry(ie); err != nil {
+			return err
+		}
+	}
+	if dl.snapshotWriter != nil {
+		dl.snapshotWriter.add(indexed, e.Line)
+	}
+
+	if !e.Expires.IsZero() {
+		// Rules often share their expiration time (i.e. a header
+		// expires hint), so it is only recorded once.
+		ns := e.Expires.UnixNano()
+		if dl.expiries == nil {
+			dl.expiries = make(map[int64]struct{})
+		}
+		dl.expiries[ns] = struct{}{}
+		next := atomic.LoadInt64(&dl.nextExpiry)
+		if next == 0 || ns < next {
+			atomic.StoreInt64(&dl.nextExpiry, ns)
+		}
+	}
+	if dl.cfg.blocksDBFactory == nil {
+		dl.Entries = append(dl.Entries, e)
+	}
+	dl.cfg.cache.invalidate()
+	return nil
+}
+
+// indexKind identifies the index in which a rule is stored.
+type indexKind byte
+
+const (
+	indexIPFS        indexKind = 'f'
+	indexIPNS        indexKind = 'n'
+	indexDoubleHash  indexKind = 'd'
+	indexPath        indexKind = 'p'
+	indexPathPattern indexKind = 'P'
+)
+
+// indexedEntry is an Entry along with the index and key under which it is
+// stored.
+type indexedEntry struct {
+	kind   indexKind
+	mhCode uint64 // for double-hashes
+	key    string
+	entry  Entry
+}
+
+// parseEntry turns a line into an Entry and returns it along with where it
+// should be indexed. It does not modify the Denylist. No indexed entries are
+// returned for lines that are not rules (comments, empty lines) or rules
+// that should be ignored. headerHints are the hints in the header of the
+// denylist.
+func (dl *Denylist) parseEntry(line string, number uint64, headerHints map[string]string) (Entry, []indexedEntry, error) {
 	line = strings.TrimSuffix(line, "\n")
 	if len(line) == 0 || line[0] == '#' {
-		return nil
+		return Entry{}, nil, nil
 	}
 
+	// Every entry shares the header hints. Rule hints take
+	// precedence when in conflict (see Entry.Hint).
 	e := Entry{
-		Line:     number,
-		RawValue: line,
-		Hints:    make(map[string]string),
-	}
-
-	// Every entry carries the header hints. They will be
-	// overwritten by rule hints below when in conflict.
-	for k, v := range dl.Header.Hints {
-		e.Hints[k] = v
+		Line:        number,
+		RawValue:    line,
+		headerHints: headerHints,
 	}
 
 	// the rule is always field-0. Anything else is hints.
@@ -363,7 +1026,10 @@ func (dl *Denylist) parseLine(line string, number uint64) error {
 			if !ok {
 				continue
 			}
-			e.Hints[key] = value
+			if e.RuleHints == nil {
+				e.RuleHints = make(map[string]string)
+			}
+			e.RuleHints[key] = value
 		}
 	}
 
@@ -379,108 +1045,130 @@ func (dl *Denylist) parseLine(line string, number uint64) error {
 		e.AllowRule = true
 		rule = unprefixed
 	}
+	// Every rule in an allowlist allows, prefixed or not.
+	if dl.allowlist {
+		e.AllowRule = true
+	}
+
+	if v, ok := e.Hint(HintNotBefore); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return e, nil, fmt.Errorf("invalid %s hint: %w (%s:%d)", HintNotBefore, err, dl.Filename, number)
+		}
+		e.NotBefore = t
+	}
+	if v, ok := e.Hint(HintExpires); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return e, nil, fmt.Errorf("invalid %s hint: %w (%s:%d)", HintExpires, err, dl.Filename, number)
+		}
+		e.Expires = t
+	}
 
 	switch {
 	case strings.HasPrefix(rule, "//"):
 		// Double-hash rule.
-		// It can be a Multihash or a sha256-hex-encoded string.
+		// It can be a Multihash or a hex-encoded string.
 
 		rule = strings.TrimPrefix(rule, "//")
 
-		parseMultihash := func(mhStr string) (uint64, multihash.Multihash, error) {
-			mh, err := multihash.FromB58String(rule)
-			if err != nil { // not a b58 string usually
-				return 0, nil, err
-			}
-			dmh, err := multihash.Decode(mh)
-			if err != nil { // looked like a mhash but it was not.
-				return 0, nil, err
-			}
+		var indexed []indexedEntry
+		addRule := func(e Entry, mhType uint64, mh multihash.Multihash) {
+			bpath, _ := NewBlockedPath("")
+			e.Path = bpath
+			e.Multihash = mh
 
-			// Identity hash doesn't make sense for double
-			// hashing.  In practice it is usually a hex string
-			// that has been wrongly parsed as multihash.
-			if dmh.Code == 0 {
-				return 0, nil, errors.New("identity hash cannot be a double hash")
-			}
+			// Store it in the appropriate BlocksDB (per mhtype).
+			indexed = append(indexed, indexedEntry{
+				kind:   indexDoubleHash,
+				mhCode: mhType,
+				key:    string(e.Multihash),
+				entry:  e,
+			})
+		}
 
-			// if we are here it means we have something that
-			// could be interpreted as a multihash but it may
-			// still be a hex-encoded string that just parsed as
-			// b58 fine. In any case, we should check we know how to
-			// hash for this type of multihash.
-			_, err = mhreg.GetVariableHasher(dmh.Code, dmh.Length)
+		// The double_hash_fn and double_hash_enc hints tell us
+		// how to decode the rule.
+		fnCode := uint64(0)
+		if fn, ok := e.Hint(HintDoubleHashFn); ok {
+			code, err := parseDoubleHashFn(fn)
 			if err != nil {
-				return 0, nil, err
+				return e, nil, fmt.Errorf("%w (%s:%d)", err, dl.Filename, number)
 			}
-
-			return dmh.Code, mh, nil
+			fnCode = code
 		}
 
-		parseHexString := func(hexStr string) (uint64, multihash.Multihash, error) {
-			if len(hexStr) != 64 {
-				return 0, nil, errors.New("hex string are sha2-256 hashes and must be 64 chars (32 bytes) long")
+		// Rules that do not match the hints, but are valid
+		// otherwise, are dropped with a warning: lists may set
+		// hints in the header that do not suit all their rules.
+		switch enc, _ := e.Hint(HintDoubleHashEnc); enc {
+		case "hex":
+			hexCode := fnCode
+			if hexCode == 0 {
+				hexCode = multihash.SHA2_256
 			}
-
-			bs, err := hex.DecodeString(rule)
+			mh, err := parseDoubleHashHex(rule, hexCode)
 			if err != nil {
-				return 0, nil, err
+				if _, _, mhErr := parseDoubleHashMultihash(rule, 0); mhErr == nil {
+					dl.cfg.logger.Warnf("Ignored: double-hash is a multihash but double_hash_enc is hex (%s:%d)", dl.Filename, number)
+					return e, nil, nil
+				}
+				return e, nil, fmt.Errorf("double-hash cannot be parsed as a hex-encoded string (%w) (%s:%d)", err, dl.Filename, number)
 			}
-			// We have a hex-encoded string and assume it is a
-			// SHA2_256. TODO: could support hints here to use
-			// different functions.
-			mhBytes, err := multihash.Encode(bs, multihash.SHA2_256)
+			addRule(e, hexCode, mh)
+		case "b58", "base58btc":
+			code, mh, err := parseDoubleHashMultihash(rule, fnCode)
 			if err != nil {
-				return 0, nil, err
+				if _, _, mhErr := parseDoubleHashMultihash(rule, 0); mhErr == nil {
+					dl.cfg.logger.Warnf("Ignored: double-hash %s (%s:%d)", err, dl.Filename, number)
+					return e, nil, nil
+				}
+				if _, hexErr := parseDoubleHashHex(rule, multihash.SHA2_256); hexErr == nil {
+					dl.cfg.logger.Warnf("Ignored: double-hash is hex-encoded but double_hash_enc is %s (%s:%d)", enc, dl.Filename, number)
+					return e, nil, nil
+				}
+				return e, nil, fmt.Errorf("double-hash cannot be parsed as a multihash with a supported hashing function (%w) (%s:%d)", err, dl.Filename, number)
+			}
+			addRule(e, code, mh)
+		case "":
+			// We have to assume that perhaps one day a sha256 hex
+			// string is going to parse as a valid multihash with
+			// an known hashing function etc. And vice-versa
+			// perhaps.
+			//
+			// In a case where we cannot distinguish between a
+			// b58btc multihash and a hex-string, we add rules for
+			// both, to make sure we always block what should be
+			// blocked. Lists can avoid this using the
+			// double_hash_enc hint.
+			code, mh, err1 := parseDoubleHashMultihash(rule, fnCode)
+			if err1 == nil {
+				// addRule works on a copy of the entry. Both
+				// copies share the hints, which are not
+				// modified after parsing.
+				addRule(e, code, mh)
 			}
-			return multihash.SHA2_256, multihash.Multihash(mhBytes), nil
-		}
-
-		addRule := func(e Entry, mhType uint64, mh multihash.Multihash) error {
-			bpath, _ := NewBlockedPath("")
-			e.Path = bpath
-			e.Multihash = mh
 
-			// Store it in the appropriate BlocksDB (per mhtype).
-			key := e.Multihash.B58String()
-			if blocks := dl.DoubleHashBlocksDB[mhType]; blocks == nil {
-				dl.DoubleHashBlocksDB[mhType] = &BlocksDB{}
+			hexCode := fnCode
+			if hexCode == 0 {
+				hexCode = multihash.SHA2_256
 			}
-			dl.DoubleHashBlocksDB[mhType].Store(key, e)
-			logger.Debugf("%s:%d: Double-hash rule. Func: %s. Key: %s. Entry: %s", filepath.Base(dl.Filename), number, multicodec.Code(mhType).String(), key, e)
-			return nil
-		}
-
-		// We have to assume that perhaps one day a sha256 hex string
-		// is going to parse as a valid multihash with an known
-		// hashing function etc. And vice-versa perhaps.
-		//
-		// In a case where we cannot distinguish between a b58btc
-		// multihash and a hex-string, we add rules for both, to make
-		// sure we always block what should be blocked.
-		code, mh, err1 := parseMultihash(rule)
-		if err1 == nil {
-			// clone the entry as add-rule modifies it.
-			e1 := e.Clone()
-			if err := addRule(e1, code, mh); err != nil {
-				return err
+			mh, err2 := parseDoubleHashHex(rule, hexCode)
+			if err2 == nil {
+				addRule(e, hexCode, mh)
 			}
-		}
 
-		code, mh, err2 := parseHexString(rule)
-		if err2 == nil {
-			if err := addRule(e, code, mh); err != nil {
-				return err
+			if err1 != nil && err2 != nil {
+				return e, nil, fmt.Errorf("double-hash cannot be parsed as a multihash with a supported hashing function (%w) nor as a hex-encoded string (%w) (%s:%d)", err1, err2, dl.Filename, number)
 			}
+		default:
+			return e, nil, fmt.Errorf("unsupported double_hash_enc: %s (%s:%d)", enc, dl.Filename, number)
 		}
-
-		if err1 != nil && err2 != nil {
-			return fmt.Errorf("double-hash cannot be parsed as a multihash with a supported hashing function (%w) nor as a sha256 hex-encoded string (%w) (%s:%d)", err1, err2, dl.Filename, number)
-		}
+		return e, indexed, nil
 
 	case strings.HasPrefix(rule, "/ipfs/"), strings.HasPrefix(rule, "/ipld/"):
 		// ipfs/ipld rule. We parse the CID and use the
-		// b58-encoded-multihash as key to the Entry.
+		// multihash as key to the Entry.
 
 		rule = strings.TrimPrefix(rule, "/ipfs/")
 		rule = strings.TrimPrefix(rule, "/ipld/")
@@ -488,103 +1176,360 @@ func (dl *Denylist) parseLine(line string, number uint64) error {
 
 		c, err := cid.Decode(cidStr)
 		if err != nil {
-			return fmt.Errorf("error extracting cid %s (%s:%d): %w", cidStr, dl.Filename, number, err)
+			return e, nil, fmt.Errorf("error extracting cid %s (%s:%d): %w", cidStr, dl.Filename, number, err)
 		}
 
 		// Blocking these by mistake can break some applications (by
 		// "some" we mean Kubo).
-		if _, ok := SafeCids[c]; ok {
-			logger.Warnf("Ignored: %s corresponds to a known empty folder or block and will not be blocked", c)
-			return nil
+		if _, ok := dl.cfg.safeCids[c]; ok {
+			dl.cfg.logger.Warnf("Ignored: %s corresponds to a known empty folder or block and will not be blocked", c)
+			return e, nil, nil
 		}
 
 		e.Multihash = c.Hash()
 
 		blockedPath, err := NewBlockedPath(subPath)
 		if err != nil {
-			return err
+			return e, nil, err
 		}
 		e.Path = blockedPath
 
 		// Add to IPFS by component multihash
-		key := e.Multihash.B58String()
-		dl.IPFSBlocksDB.Store(key, e)
-		logger.Debugf("%s:%d: IPFS rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), number, key, e)
+		return e, []indexedEntry{{kind: indexIPFS, key: string(e.Multihash), entry: e}}, nil
 	case strings.HasPrefix(rule, "/ipns/"):
 		// ipns rule. If it carries anything parseable as a CID, we
-		// store indexed by the b58-multihash. Otherwise assume it is
-		// a domain name and store that directly.
+		// store indexed by the multihash. Otherwise assume it is
+		// a domain name and store that directly. A "*" name applies
+		// to every name and is stored as such.
 		rule, _ = cutPrefix(rule, "/ipns/")
 		key, subPath, _ := strings.Cut(rule, "/")
 		c, err := cid.Decode(key)
 		if err == nil { // CID key handling.
-			key = c.Hash().B58String()
+			key = string(c.Hash())
+		} else if mh, err := multihash.FromB58String(key); err == nil {
+			// b58-encoded multihash (legacy peer ID).
+			key = string(mh)
 		}
 		blockedPath, err := NewBlockedPath(subPath)
 		if err != nil {
-			return err
+			return e, nil, err
 		}
 		e.Path = blockedPath
 
-		// Add to IPFS by component multihash
-		dl.IPNSBlocksDB.Store(key, e)
-		logger.Debugf("%s:%d: IPNS rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), number, key, e)
+		return e, []indexedEntry{{kind: indexIPNS, key: key, entry: e}}, nil
 	default:
 		// Blocked by path only. We store non-prefix paths directly.
-		// We store prefixed paths separately as every path request
-		// will have to loop them.
+		// We store prefixed paths and paths with wildcards
+		// separately in an index.
 		blockedPath, err := NewBlockedPath(rule)
 		if err != nil {
-			return err
+			return e, nil, err
 		}
 		e.Path = blockedPath
 
-		key := rule
-		if blockedPath.Prefix {
-			dl.PathPrefixBlocks = append(dl.PathPrefixBlocks, e)
-		} else {
-			dl.PathBlocksDB.Store(key, e)
+		// Exact paths are keyed by the sanitized path, as used
+		// in lookups.
+		kind := indexPath
+		key := blockedPath.Path
+		if blockedPath.Prefix || blockedPath.IsGlob() {
+			kind = indexPathPattern
+			key = rule
 		}
-		logger.Debugf("%s:%d: Path rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), number, key, e)
+		return e, []indexedEntry{{kind: kind, key: key, entry: e}}, nil
 	}
+}
 
-	dl.Entries = append(dl.Entries, e)
+// storeEntry adds an Entry to the index given by its kind.
+func (dl *Denylist) storeEntry(ie indexedEntry) error {
+	e := ie.entry
+	switch ie.kind {
+	case indexIPFS:
+		dl.cfg.logger.Debugf("%s:%d: IPFS rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), e.Line, b58Key(ie.key), e)
+		if dl.cfg.bloom != nil {
+			dl.cfg.bloom.add(e.Multihash)
+		}
+		return dl.IPFSBlocksDB.Store(ie.key, e)
+	case indexIPNS:
+		dl.cfg.logger.Debugf("%s:%d: IPNS rule. Entry: %s", filepath.Base(dl.Filename), e.Line, e)
+		return dl.IPNSBlocksDB.Store(ie.key, e)
+	case indexDoubleHash:
+		dl.cfg.logger.Debugf("%s:%d: Double-hash rule. Func: %s. Key: %s. Entry: %s", filepath.Base(dl.Filename), e.Line, multicodec.Code(ie.mhCode), b58Key(ie.key), e)
+		db, err := dl.doubleHashBlocksDB(ie.mhCode)
+		if err != nil {
+			return err
+		}
+		if dl.cfg.bloom != nil {
+			dl.cfg.bloom.add(e.Multihash)
+		}
+		return db.Store(ie.key, e)
+	case indexPath:
+		dl.cfg.logger.Debugf("%s:%d: Path rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), e.Line, ie.key, e)
+		return dl.PathBlocksDB.Store(ie.key, e)
+	case indexPathPattern:
+		dl.cfg.logger.Debugf("%s:%d: Path rule. Key: %s. Entry: %s", filepath.Base(dl.Filename), e.Line, ie.key, e)
+		dl.pathPatternBlocks.add(e)
+	}
 	return nil
+}
+
+// IsAllowlist returns whether the denylist is an allowlist: a file with the
+// ".allow" extension, in which every rule is an allow rule, with or without
+// the "+", "-" or "!" prefixes. In a Blocker, allowlists take precedence over
+// all denylists, regardless of their priority, so that the items they allow
+// are never blocked.
+func (dl *Denylist) IsAllowlist() bool {
+	return dl.allowlist
+}
+
+// Priority returns the priority of the denylist, as set by the "priority"
+// hint in its header. Denylists with higher priority take precedence in a
+// Blocker. The priority is 0 when not set or not a valid integer. Note that
+// the Blocker uses the priority at the time the Denylist is added to it.
+func (dl *Denylist) Priority() int {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+
+	v, ok := dl.Header.Hints[HintPriority]
+	if !ok {
+		return 0
+	}
+	prio, err := strconv.Atoi(v)
+	if err != nil {
+		dl.cfg.logger.Warnf("%s: invalid priority hint: %s", dl.Filename, v)
+		return 0
+	}
+	return prio
+}
+
+// parseDoubleHashFn returns the multihash code for the hash function
+// named in a double_hash_fn hint. Multicodec names (sha2-256, blake3...) are
+// supported, along with "sha256".
+func parseDoubleHashFn(name string) (uint64, error) {
+	if name == "sha256" {
+		return multihash.SHA2_256, nil
+	}
+	var code multicodec.Code
+	if err := code.Set(name); err != nil {
+		return 0, fmt.Errorf("unknown double_hash_fn %s: %w", name, err)
+	}
+	if _, err := mhreg.GetVariableHasher(uint64(code), -1); err != nil {
+		return 0, fmt.Errorf("unsupported double_hash_fn %s: %w", name, err)
+	}
+	return uint64(code), nil
+}
+
+// parseDoubleHashMultihash parses a b58-encoded multihash from a
+// double-hash rule. When fnCode is not 0, the multihash must use that
+// hashing function.
+func parseDoubleHashMultihash(mhStr string, fnCode uint64) (uint64, multihash.Multihash, error) {
+	mh, err := multihash.FromB58String(mhStr)
+	if err != nil { // not a b58 string usually
+		return 0, nil, err
+	}
+	dmh, err := multihash.Decode(mh)
+	if err != nil { // looked like a mhash but it was not.
+		return 0, nil, err
+	}
+
+	// Identity hash doesn't make sense for double
+	// hashing.  In practice it is usually a hex string
+	// that has been wrongly parsed as multihash.
+	if dmh.Code == 0 {
+		return 0, nil, errors.New("identity hash cannot be a double hash")
+	}
+
+	if fnCode != 0 && dmh.Code != fnCode {
+		return 0, nil, fmt.Errorf("multihash function %s does not match double_hash_fn hint", multicodec.Code(dmh.Code))
+	}
 
+	// if we are here it means we have something that
+	// could be interpreted as a multihash but it may
+	// still be a hex-encoded string that just parsed as
+	// b58 fine. In any case, we should check we know how to
+	// hash for this type of multihash.
+	_, err = mhreg.GetVariableHasher(dmh.Code, dmh.Length)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return dmh.Code, mh, nil
+}
+
+// parseDoubleHashHex parses a hex-encoded digest from a double-hash rule
+// and returns a multihash using the given hashing function.
+func parseDoubleHashHex(hexStr string, fnCode uint64) (multihash.Multihash, error) {
+	hasher, err := mhreg.GetVariableHasher(fnCode, -1)
+	if err != nil {
+		return nil, err
+	}
+	if size := hasher.Size(); len(hexStr) != size*2 {
+		return nil, fmt.Errorf("hex strings for %s hashes must be %d chars (%d bytes) long", multicodec.Code(fnCode), size*2, size)
+	}
+
+	bs, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return nil, err
+	}
+	mhBytes, err := multihash.Encode(bs, fnCode)
+	if err != nil {
+		return nil, err
+	}
+	return multihash.Multihash(mhBytes), nil
 }
 
 // Close closes the Denylist file handle and stops watching write events on it.
+// Lookups on a closed Denylist find nothing.
 func (dl *Denylist) Close() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.closed {
+		return nil
+	}
+	dl.closed = true
+
 	var err error
 	if dl.watcher != nil {
 		err = multierr.Append(err, dl.watcher.Close())
 	}
+	// Write the rules appended after the snapshot, so that they are
+	// not parsed again on the next start.
+	if sw := dl.snapshotWriter; sw != nil && sw.base && sw.pending() > 0 {
+		dl.flushSnapshot(sw, dl.Header)
+	}
+	dl.snapshotWriter = nil
 	if dl.f != nil {
 		err = multierr.Append(err, dl.f.Close())
 	}
+	// Lookups on a closed Denylist find nothing, so the indexes are
+	// released once the lookups using them finish.
+	snap := dl.snapshot
+	dl.snapshot = nil
+	if old := dl.publishIndexes(&denylistIndexes{patterns: newPathIndex()}); old != nil {
+		old.waitReaders()
+	}
+	if snap != nil {
+		err = multierr.Append(err, snap.close())
+	}
+	for _, db := range dl.blocksDBs() {
+		err = multierr.Append(err, db.Close())
+	}
 
 	return err
 }
 
+// skipEntry returns true for entries that do not apply at the current time
+// or whose categories are not enabled. Finding an expired entry triggers the
+// removal of expired entries.
+func (dl *Denylist) skipEntry(e Entry) bool {
+	if !dl.cfg.categoryEnabled(e) {
+		return true
+	}
+	if !e.timed() {
+		return false
+	}
+	now := dl.cfg.clock()
+	if e.ExpiredAt(now) {
+		dl.evictExpired()
+	}
+	// Responses involving this entry change when it does.
+	dl.cfg.cache.invalidateAt(e.nextChange(now))
+	return !e.ActiveAt(now)
+}
+
+// checkExpiry triggers the removal of expired entries when the earliest
+// expiration time has passed.
+func (dl *Denylist) checkExpiry() {
+	if next := atomic.LoadInt64(&dl.nextExpiry); next != 0 && dl.cfg.clock().UnixNano() >= next {
+		dl.evictExpired()
+	}
+}
+
+// evictExpired removes expired entries from the indexes in the background,
+// unless this is already happening. It can be called while holding the
+// lock or during lookups.
+func (dl *Denylist) evictExpired() {
+	if !atomic.CompareAndSwapInt32(&dl.evicting, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&dl.evicting, 0)
+
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		if dl.closed {
+			return
+		}
+
+		now := dl.cfg.clock()
+		expired := false
+		var next int64
+		for ns := range dl.expiries {
+			if !now.Before(time.Unix(0, ns)) {
+				delete(dl.expiries, ns)
+				expired = true
+				continue
+			}
+			if next == 0 || ns < next {
+				next = ns
+			}
+		}
+		atomic.StoreInt64(&dl.nextExpiry, next)
+		if !expired {
+			return
+		}
+
+		dl.Entries, _ = dl.Entries.removeExpired(now)
+		for _, db := range dl.blocksDBs() {
+			db.RemoveExpired(now)
+		}
+		dl.pathPatternBlocks = dl.pathPatternBlocks.removeExpired(now)
+		dl.publish()
+		dl.cfg.cache.invalidate()
+		dl.cfg.logger.Infof("%s: removed expired rules", dl.Filename)
+	}()
+}
+
+// checkIndex returns the status given by the rules stored under a key in the
+// given index, both in memory and in the snapshot, if any.
+func (dl *Denylist) checkIndex(idx *denylistIndexes, kind indexKind, mhCode uint64, key []byte, p string) (Status, Entry) {
+	status, entry := StatusNotFound, Entry{}
+	if db := idx.blocksDB(kind, mhCode); db != nil {
+		status, entry = checkPathStatus(db, key, p, dl.skip)
+	}
+	if idx.snapshot != nil {
+		snapStatus, snapEntry := dl.checkSnapshot(idx.snapshot, kind, mhCode, string(key), p)
+		status, entry = latestMatch(status, entry, snapStatus, snapEntry)
+	}
+	return status, entry
+}
+
 // IsSubpathBlocked returns Blocking Status for the given subpath.
 func (dl *Denylist) IsSubpathBlocked(subpath string) StatusResponse {
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	return dl.isSubpathBlocked(idx, subpath, nil)
+}
+
+// isSubpathBlocked works like IsSubpathBlocked. Matching rules are recorded
+// in x, if not nil.
+func (dl *Denylist) isSubpathBlocked(idx *denylistIndexes, subpath string, x *explainer) StatusResponse {
 	// all "/" prefix and suffix trimming is done in BlockedPath.Matches.
 	// every rule has been ingested without slashes on the ends
+	var buf [keyBufferSize]byte
+	key := append(buf[:0], strings.TrimSuffix(strings.TrimPrefix(subpath, "/"), "/")...)
+	status, entry := dl.checkIndex(idx, indexPath, 0, key, subpath)
 
-	logger.Debugf("IsSubpathBlocked load path: %s", subpath)
-	pathBlockEntries, _ := dl.PathBlocksDB.Load(subpath)
-	status, entry := pathBlockEntries.CheckPathStatus(subpath)
-	if status != StatusNotFound { // hit
-		return StatusResponse{
-			Status:   status,
-			Filename: dl.Filename,
-			Entry:    entry,
-		}
+	// Check prefix and wildcard paths.
+	patternStatus, patternEntry := idx.patterns.checkPathStatus(subpath, dl.skip)
+	status, entry = latestMatch(status, entry, patternStatus, patternEntry)
+
+	if x != nil {
+		dl.explainIndex(idx, x, MatchSubpath, indexPath, 0, key, subpath)
+		x.add(dl, MatchSubpath, 0, idx.patterns.appendMatches(nil, subpath, dl.skip))
 	}
-	// Check every prefix path.  Note: this is very innefficient, we
-	// should have some HAMT that we can traverse with every character if
-	// we were to support a large number of subpath-prefix blocks.
-	status, entry = dl.PathPrefixBlocks.CheckPathStatus(subpath)
+
 	return StatusResponse{
 		Status:   status,
 		Filename: dl.Filename,
@@ -617,43 +1562,54 @@ func toDNSLinkFQDN(label string) string {
 	return result.String()
 }
 
-func (dl *Denylist) checkDoubleHashWithFn(caller string, origKey string, code uint64) (Status, Entry, error) {
-	blocksdb, ok := dl.DoubleHashBlocksDB[code]
-	if !ok {
-		return StatusNotFound, Entry{}, nil
+// checkDoubleHashWithFn checks the double-hash rules that use the given
+// hashing function against the hash of an input string of the lookup, which
+// must have been set.
+func (dl *Denylist) checkDoubleHashWithFn(idx *denylistIndexes, lh *lookupHashes, in hashInput, code uint64) (Status, Entry) {
+	if _, ok := idx.doubleHash[code]; !ok {
+		return StatusNotFound, Entry{}
 	}
 	// Double-hash the key
-	doubleHash, err := multihash.Sum([]byte(origKey), code, -1)
+	doubleHash, err := lh.doubleHash(in, code)
 	if err != nil {
 		// Usually this means an unsupported hash function was
 		// registered. We log and ignore.
-		logger.Error(err)
-		return StatusNotFound, Entry{}, nil
+		dl.cfg.logger.Error(err)
+		return StatusNotFound, Entry{}
 	}
-	b58DoubleHash := doubleHash.B58String()
-	logger.Debugf("%s load IPNS doublehash: %d %s", caller, code, b58DoubleHash)
-	entries, _ := blocksdb.Load(b58DoubleHash)
-	status, entry := entries.CheckPathStatus("") // double-hashes cannot have entry-subpaths
-	return status, entry, nil
+	if x := lh.explain; x != nil {
+		stage := MatchDoubleHash
+		if in == inputLegacy {
+			stage = MatchLegacyDoubleHash
+		}
+		dl.explainIndex(idx, x, stage, indexDoubleHash, code, doubleHash, "")
+	}
+	return dl.checkIndex(idx, indexDoubleHash, code, doubleHash, "") // double-hashes cannot have entry-subpaths
 }
 
-func (dl *Denylist) checkDoubleHash(caller string, origKey string) (Status, Entry, error) {
-	for mhCode := range dl.DoubleHashBlocksDB {
-		status, entry, err := dl.checkDoubleHashWithFn(caller, origKey, mhCode)
-		if err != nil {
-			return status, entry, err
-		}
-		if status != StatusNotFound { // hit!
-			return status, entry, nil
+// checkDoubleHash checks the double-hash rules for all the hashing functions
+// in use against the hashes of an input string of the lookup, which must
+// have been set.
+func (dl *Denylist) checkDoubleHash(idx *denylistIndexes, lh *lookupHashes, in hashInput) (Status, Entry) {
+	for mhCode := range idx.doubleHash {
+		status, entry := dl.checkDoubleHashWithFn(idx, lh, in, mhCode)
+		if status != StatusNotFound && lh.explain == nil { // hit!
+			return status, entry
 		}
 	}
-	return StatusNotFound, Entry{}, nil
-
+	return StatusNotFound, Entry{}
 }
 
 // IsIPNSPathBlocked returns Blocking Status for a given IPNS name and its
 // subpath. The name is NOT an "/ipns/name" path, but just the name.
 func (dl *Denylist) IsIPNSPathBlocked(name, subpath string) StatusResponse {
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	var lh lookupHashes
+	return dl.isIPNSPathBlocked(idx, name, subpath, &lh)
+}
+
+func (dl *Denylist) isIPNSPathBlocked(idx *denylistIndexes, name, subpath string, lh *lookupHashes) StatusResponse {
 	subpath = strings.TrimPrefix(subpath, "/")
 
 	var p path.Path
@@ -669,22 +1625,33 @@ func (dl *Denylist) IsIPNSPathBlocked(name, subpath string) StatusResponse {
 			Error:  err,
 		}
 	}
-	key := name
+
+	var keyBuf [keyBufferSize]byte
+	var key []byte
 	// Check if it is a CID and use the multihash as key then
-	c, err := cid.Decode(key)
+	c, err := cid.Decode(name)
 	if err == nil {
-		key = c.Hash().B58String()
-		//
-	} else if !strings.ContainsRune(key, '.') {
+		key = cidMultihash(keyBuf[:0], c)
+	} else if mh, err := multihash.FromB58String(name); err == nil {
+		// Keys can also be b58-encoded multihashes (legacy peer
+		// IDs).
+		key = append(keyBuf[:0], mh...)
+	} else if !strings.ContainsRune(name, '.') {
 		// not a CID. It must be a ipns-dnslink name if it does not
 		// contain ".", maybe they got replaced by "-"
 		// https://specs.ipfs.tech/http-gateways/subdomain-gateway/#host-request-header
-		key = toDNSLinkFQDN(key)
+		key = append(keyBuf[:0], toDNSLinkFQDN(name)...)
+	} else {
+		key = append(keyBuf[:0], name...)
 	}
-	logger.Debugf("IsIPNSPathBlocked load: %s %s", key, subpath)
-	entries, _ := dl.IPNSBlocksDB.Load(key)
-	status, entry := entries.CheckPathStatus(subpath)
-	if status != StatusNotFound { // hit!
+	status, entry := dl.checkIndex(idx, indexIPNS, 0, key, subpath)
+	// Rules for any name ("/ipns/*/path").
+	anyStatus, anyEntry := dl.checkIndex(idx, indexIPNS, 0, []byte("*"), subpath)
+	status, entry = latestMatch(status, entry, anyStatus, anyEntry)
+	if x := lh.explain; x != nil {
+		dl.explainIndex(idx, x, MatchDirect, indexIPNS, 0, key, subpath)
+		dl.explainIndex(idx, x, MatchDirect, indexIPNS, 0, []byte("*"), subpath)
+	} else if status != StatusNotFound { // hit!
 		return StatusResponse{
 			Path:     p,
 			Status:   status,
@@ -693,86 +1660,104 @@ func (dl *Denylist) IsIPNSPathBlocked(name, subpath string) StatusResponse {
 		}
 	}
 
-	// Double-hash blocking, works by double-hashing "/ipns/<name>/<path>"
-	// Legacy double-hashes for dnslink will hash "domain.com/" (trailing
-	// slash) or "<cidV1b32>/" for ipns-key blocking
-	legacyKey := name + "/" + subpath
-	if c.Defined() { // we parsed a CID before
-		legacyCid, err := cid.NewCidV1(c.Prefix().Codec, c.Hash()).StringOfBase(multibase.Base32)
-		if err != nil {
+	if len(idx.doubleHash) == 0 {
+		return StatusResponse{
+			Path:     p,
+			Status:   StatusNotFound,
+			Filename: dl.Filename,
+		}
+	}
+
+	if dl.cfg.legacyDoubleHash {
+		// Double-hash blocking, works by double-hashing "/ipns/<name>/<path>"
+		// Legacy double-hashes for dnslink will hash "domain.com/" (trailing
+		// slash) or "<cidV1b32>/" for ipns-key blocking
+		if !lh.hasInput(inputLegacy) {
+			var legacyKey []byte
+			if c.Defined() { // we parsed a CID before
+				legacyKey = appendCidV1B32(lh.inputBuffer(inputLegacy), c.Type(), key)
+			} else {
+				legacyKey = append(lh.inputBuffer(inputLegacy), name...)
+			}
+			legacyKey = append(legacyKey, '/')
+			lh.setInput(inputLegacy, append(legacyKey, subpath...))
+		}
+		status, entry = dl.checkDoubleHashWithFn(idx, lh, inputLegacy, multihash.SHA2_256)
+		if status != StatusNotFound && lh.explain == nil { // hit
 			return StatusResponse{
 				Path:     p,
-				Status:   StatusErrored,
+				Status:   status,
 				Filename: dl.Filename,
-				Error:    err,
+				Entry:    entry,
 			}
 		}
-		legacyKey = legacyCid + "/" + subpath
-	}
-	status, entry, err = dl.checkDoubleHashWithFn("IsIPNSPathBlocked (legacy)", legacyKey, multihash.SHA2_256)
-	if status != StatusNotFound { // hit or error
-		return StatusResponse{
-			Path:     p,
-			Status:   status,
-			Filename: dl.Filename,
-			Entry:    entry,
-			Error:    err,
-		}
 	}
 
 	// Modern double-hash approach
-	key = p.String()
-	if c.Defined() { // the ipns path is a CID The
-		// b58-encoded-multihash extracted from an IPNS name
-		// when the IPNS is a CID.
-		key = c.Hash().B58String()
-		if len(subpath) > 0 {
-			key += "/" + subpath
+	if !lh.hasInput(inputModern) {
+		var data []byte
+		if c.Defined() { // the ipns path is a CID The
+			// b58-encoded-multihash extracted from an IPNS name
+			// when the IPNS is a CID.
+			data = appendB58(lh.inputBuffer(inputModern), key)
+			if len(subpath) > 0 {
+				data = append(data, '/')
+				data = append(data, subpath...)
+			}
+		} else {
+			data = append(lh.inputBuffer(inputModern), p.String()...)
 		}
+		lh.setInput(inputModern, data)
 	}
 
-	status, entry, err = dl.checkDoubleHash("IsIPNSPathBlocked", key)
+	status, entry = dl.checkDoubleHash(idx, lh, inputModern)
 	return StatusResponse{
 		Path:     p,
 		Status:   status,
 		Filename: dl.Filename,
 		Entry:    entry,
-		Error:    err,
 	}
 }
 
 // IsIPFSPathBlocked returns Blocking Status for a given IPFS CID and its
 // subpath. The cidStr is NOT an "/ipns/cid" path, but just the cid.
 func (dl *Denylist) IsIPFSPathBlocked(cidStr, subpath string) StatusResponse {
-	return dl.isIPFSIPLDPathBlocked(cidStr, subpath, "ipfs")
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	var lh lookupHashes
+	return dl.isIPFSIPLDPathBlocked(idx, nil, cidStr, subpath, "ipfs", &lh)
 }
 
 // IsIPLDPathBlocked returns Blocking Status for a given IPLD CID and its
 // subpath. The cidStr is NOT an "/ipld/cid" path, but just the cid.
 func (dl *Denylist) IsIPLDPathBlocked(cidStr, subpath string) StatusResponse {
-	return dl.isIPFSIPLDPathBlocked(cidStr, subpath, "ipld")
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	var lh lookupHashes
+	return dl.isIPFSIPLDPathBlocked(idx, nil, cidStr, subpath, "ipld", &lh)
 }
 
-func (dl *Denylist) isIPFSIPLDPathBlocked(cidStr, subpath, protocol string) StatusResponse {
+// isIPFSIPLDPathBlocked checks an IPFS or IPLD path given by its parts. p is
+// the full path, used in the response, or nil when it needs to be built
+// from the parts.
+func (dl *Denylist) isIPFSIPLDPathBlocked(idx *denylistIndexes, p path.Path, cidStr, subpath, protocol string, lh *lookupHashes) StatusResponse {
 	subpath = strings.TrimPrefix(subpath, "/")
 
-	var p path.Path
-	var err error
-	if len(subpath) > 0 {
-		p, err = path.NewPath("/" + protocol + "/" + cidStr + "/" + subpath)
-	} else {
-		p, err = path.NewPath("/" + protocol + "/" + cidStr)
-	}
-
-	if err != nil {
-		return StatusResponse{
-			Status: StatusErrored,
-			Error:  err,
+	if p == nil {
+		var err error
+		if len(subpath) > 0 {
+			p, err = path.NewPath("/" + protocol + "/" + cidStr + "/" + subpath)
+		} else {
+			p, err = path.NewPath("/" + protocol + "/" + cidStr)
+		}
+		if err != nil {
+			return StatusResponse{
+				Status: StatusErrored,
+				Error:  err,
+			}
 		}
 	}
 
-	key := cidStr
-
 	// This could be a shortcut to let the work to the
 	// blockservice.  Assuming IsCidBlocked() is going to be
 	// called later down the stack (by IPFS).
@@ -782,13 +1767,22 @@ func (dl *Denylist) isIPFSIPLDPathBlocked(cidStr, subpath, protocol string) Stat
 	// 	return false
 	// }
 
+	// CIDv0s are just b58-encoded multihashes, which we can decode
+	// without allocating. Other CIDs need to be parsed.
+	var keyBuf [keyBufferSize]byte
+	var key []byte
 	var c cid.Cid
-	if len(key) != 46 || key[:2] != "Qm" {
-		// Key is not a CIDv0, we need to convert other CIDs.
-		// convert to Multihash (cidV0)
-		c, err = cid.Decode(key)
+	isV0 := false
+	if len(cidStr) == 46 && cidStr[:2] == "Qm" {
+		var err error
+		key, err = decodeB58(keyBuf[:0], cidStr)
+		isV0 = err == nil
+	}
+	if !isV0 {
+		var err error
+		c, err = cid.Decode(cidStr)
 		if err != nil {
-			logger.Warnf("could not decode %s as CID: %s", key, err)
+			dl.cfg.logger.Warnf("could not decode %s as CID: %s", cidStr, err)
 			return StatusResponse{
 				Path:     p,
 				Status:   StatusErrored,
@@ -796,13 +1790,13 @@ func (dl *Denylist) isIPFSIPLDPathBlocked(cidStr, subpath, protocol string) Stat
 				Error:    err,
 			}
 		}
-		key = c.Hash().B58String()
+		key = cidMultihash(keyBuf[:0], c)
 	}
 
-	logger.Debugf("isIPFSIPLDPathBlocked load: %s %s", key, subpath)
-	entries, _ := dl.IPFSBlocksDB.Load(key)
-	status, entry := entries.CheckPathStatus(subpath)
-	if status != StatusNotFound { // hit!
+	status, entry := dl.checkIndex(idx, indexIPFS, 0, key, subpath)
+	if x := lh.explain; x != nil {
+		dl.explainIndex(idx, x, MatchDirect, indexIPFS, 0, key, subpath)
+	} else if status != StatusNotFound { // hit!
 		return StatusResponse{
 			Path:     p,
 			Status:   status,
@@ -811,63 +1805,64 @@ func (dl *Denylist) isIPFSIPLDPathBlocked(cidStr, subpath, protocol string) Stat
 		}
 	}
 
+	if len(idx.doubleHash) == 0 {
+		return StatusResponse{
+			Path:     p,
+			Status:   StatusNotFound,
+			Filename: dl.Filename,
+		}
+	}
+
 	// Check for double-hashed entries. We need to lookup both the
 	// multihash+path and the base32-cidv1 + path
-	if !c.Defined() { // if we didn't decode before...
-		c, err = cid.Decode(cidStr)
-		if err != nil {
-			logger.Warnf("could not decode %s as CID: %s", key, err)
+	if dl.cfg.legacyDoubleHash {
+		// Checks for legacy doublehash blocking
+		// <cidv1base32>/<path>
+		// Can be disabled with the WithLegacyDoubleHash option.
+		// badbits appends / on empty subpath. and hashes that
+		// https://specs.ipfs.tech/compact-denylist-format/#double-hash
+		if !lh.hasInput(inputLegacy) {
+			codec := uint64(cid.DagProtobuf)
+			if !isV0 {
+				codec = c.Type()
+			}
+			v1b32path := appendCidV1B32(lh.inputBuffer(inputLegacy), codec, key)
+			v1b32path = append(v1b32path, '/')
+			lh.setInput(inputLegacy, append(v1b32path, subpath...))
+		}
+		status, entry = dl.checkDoubleHashWithFn(idx, lh, inputLegacy, multihash.SHA2_256)
+		if status != StatusNotFound && lh.explain == nil { // hit
 			return StatusResponse{
 				Path:     p,
-				Status:   StatusErrored,
+				Status:   status,
 				Filename: dl.Filename,
-				Error:    err,
+				Entry:    entry,
 			}
 		}
 	}
 
-	prefix := c.Prefix()
-	// Checks for legacy doublehash blocking
-	// <cidv1base32>/<path>
-	// TODO: we should be able to disable this part with an Option
-	// or a hint for denylists not using it.
-	v1b32, err := cid.NewCidV1(prefix.Codec, c.Hash()).StringOfBase(multibase.Base32) // base32 string
-	if err != nil {
-		return StatusResponse{
-			Path:     p,
-			Status:   StatusErrored,
-			Filename: dl.Filename,
-			Error:    err,
-		}
-	}
-	// badbits appends / on empty subpath. and hashes that
-	// https://specs.ipfs.tech/compact-denylist-format/#double-hash
-	v1b32path := v1b32 + "/" + subpath
-	status, entry, err = dl.checkDoubleHashWithFn("IsIPFSIPLDPathBlocked (legacy)", v1b32path, multihash.SHA2_256)
-	if status != StatusNotFound { // hit or error
-		return StatusResponse{
-			Path:     p,
-			Status:   status,
-			Filename: dl.Filename,
-			Entry:    entry,
-			Error:    err,
-		}
-	}
-
 	// Otherwise just check normal double-hashing of multihash
 	// for all double-hashing functions used.
 	// <cidv0>/<path>
-	v0path := c.Hash().B58String()
-	if subpath != "" {
-		v0path += "/" + subpath
+	if !lh.hasInput(inputModern) {
+		var v0path []byte
+		if isV0 {
+			v0path = append(lh.inputBuffer(inputModern), cidStr...)
+		} else {
+			v0path = appendB58(lh.inputBuffer(inputModern), key)
+		}
+		if subpath != "" {
+			v0path = append(v0path, '/')
+			v0path = append(v0path, subpath...)
+		}
+		lh.setInput(inputModern, v0path)
 	}
-	status, entry, err = dl.checkDoubleHash("IsIPFSIPLDPathBlocked", v0path)
+	status, entry = dl.checkDoubleHash(idx, lh, inputModern)
 	return StatusResponse{
 		Path:     p,
 		Status:   status,
 		Filename: dl.Filename,
 		Entry:    entry,
-		Error:    err,
 	}
 }
 
@@ -883,8 +1878,23 @@ func (dl *Denylist) isIPFSIPLDPathBlocked(cidStr, subpath, protocol string) Stat
 //
 //   - A small number of path-only match rules using prefixes are used.
 func (dl *Denylist) IsPathBlocked(p path.Path) StatusResponse {
-	segments := p.Segments()
-	if len(segments) < 2 {
+	var lh lookupHashes
+	return dl.isPathBlocked(p, &lh)
+}
+
+// isPathBlocked works like IsPathBlocked, using and filling the given
+// lookupHashes.
+func (dl *Denylist) isPathBlocked(p path.Path, lh *lookupHashes) StatusResponse {
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	dl.checkExpiry()
+
+	// Paths are clean ("/<proto>/<key>/<subpath>"), so we can split them
+	// without allocating.
+	proto, rest, _ := strings.Cut(strings.TrimPrefix(p.String(), "/"), "/")
+	key, subpath, _ := strings.Cut(rest, "/")
+	subpath = strings.TrimSuffix(subpath, "/")
+	if proto == "" || key == "" {
 		return StatusResponse{
 			Path:     p,
 			Status:   StatusErrored,
@@ -892,13 +1902,11 @@ func (dl *Denylist) IsPathBlocked(p path.Path) StatusResponse {
 			Error:    errors.New("path is too short"),
 		}
 	}
-	proto := segments[0]
-	key := segments[1]
-	subpath := strings.Join(segments[2:], "/")
 
 	// First, check that we are not blocking this subpath in general
 	if len(subpath) > 0 {
-		if resp := dl.IsSubpathBlocked(subpath); resp.Status != StatusNotFound {
+		resp := dl.isSubpathBlocked(idx, subpath, lh.explain)
+		if resp.Status != StatusNotFound && lh.explain == nil {
 			resp.Path = p
 			return resp
 		}
@@ -911,11 +1919,9 @@ func (dl *Denylist) IsPathBlocked(p path.Path) StatusResponse {
 
 	switch proto {
 	case "ipns":
-		return dl.IsIPNSPathBlocked(key, subpath)
-	case "ipfs":
-		return dl.IsIPFSPathBlocked(key, subpath)
-	case "ipld":
-		return dl.IsIPLDPathBlocked(key, subpath)
+		return dl.isIPNSPathBlocked(idx, key, subpath, lh)
+	case "ipfs", "ipld":
+		return dl.isIPFSIPLDPathBlocked(idx, p, key, subpath, proto, lh)
 	default:
 		return StatusResponse{
 			Path:     p,
@@ -928,13 +1934,30 @@ func (dl *Denylist) IsPathBlocked(p path.Path) StatusResponse {
 // IsCidBlocked provides Blocking Status for a given CID.  This is done by
 // extracting the multihash and checking if it is blocked by any rule.
 func (dl *Denylist) IsCidBlocked(c cid.Cid) StatusResponse {
-	b58 := c.Hash().B58String()
-	logger.Debugf("IsCidBlocked load: %s", b58)
-	entries, _ := dl.IPFSBlocksDB.Load(b58)
+	var lh lookupHashes
+	return dl.isCidBlocked(c, &lh)
+}
+
+// isCidBlocked works like IsCidBlocked, using and filling the given
+// lookupHashes.
+func (dl *Denylist) isCidBlocked(c cid.Cid, lh *lookupHashes) StatusResponse {
+	idx := dl.acquireIndexes()
+	defer dl.releaseIndexes(idx)
+	dl.checkExpiry()
+	return dl.checkCid(idx, c, lh)
+}
+
+// checkCid checks a CID against the given indexes. Several CIDs can be
+// checked with the same indexes (see Blocker.AreCidsBlocked).
+func (dl *Denylist) checkCid(idx *denylistIndexes, c cid.Cid, lh *lookupHashes) StatusResponse {
+	var keyBuf [keyBufferSize]byte
+	mh := cidMultihash(keyBuf[:0], c)
 	// Look for an entry with an empty path
 	// which means the Mhash itself is blocked.
-	status, entry := entries.CheckPathStatus("")
-	if status != StatusNotFound { // Hit!
+	status, entry := dl.checkIndex(idx, indexIPFS, 0, mh, "")
+	if x := lh.explain; x != nil {
+		dl.explainIndex(idx, x, MatchDirect, indexIPFS, 0, mh, "")
+	} else if status != StatusNotFound { // Hit!
 		return StatusResponse{
 			Cid:      c,
 			Status:   status,
@@ -943,41 +1966,39 @@ func (dl *Denylist) IsCidBlocked(c cid.Cid) StatusResponse {
 		}
 	}
 
-	// Now check if a double-hash covers this CID
-
-	// Legacy double-hashing support.
-	// convert cid to v1 base32
-	// the double-hash using multhash sha2-256
-	// then check that
-	prefix := c.Prefix()
-	b32, err := cid.NewCidV1(prefix.Codec, c.Hash()).StringOfBase(multibase.Base32)
-	if err != nil {
+	if len(idx.doubleHash) == 0 {
 		return StatusResponse{
 			Cid:      c,
-			Status:   StatusErrored,
+			Status:   StatusNotFound,
 			Filename: dl.Filename,
-			Error:    err,
 		}
 	}
-	b32 += "/" // yes, needed
-	status, entry, err = dl.checkDoubleHashWithFn("IsCidBlocked (legacy)", b32, multihash.SHA2_256)
-	if status != StatusNotFound { // hit or error
-		return StatusResponse{
-			Cid:      c,
-			Status:   status,
-			Filename: dl.Filename,
-			Entry:    entry,
-			Error:    err,
+
+	// Now check if a double-hash covers this CID
+	if dl.cfg.legacyDoubleHash {
+		// Legacy double-hashing support.
+		// convert cid to v1 base32
+		// the double-hash using multhash sha2-256
+		// then check that
+		setCidLegacyInput(lh, c, mh)
+		status, entry = dl.checkDoubleHashWithFn(idx, lh, inputLegacy, multihash.SHA2_256)
+		if status != StatusNotFound && lh.explain == nil { // hit
+			return StatusResponse{
+				Cid:      c,
+				Status:   status,
+				Filename: dl.Filename,
+				Entry:    entry,
+			}
 		}
 	}
 
-	// Otherwise, double-hash the multihash string.
-	status, entry, err = dl.checkDoubleHash("IsCidBlocked", b58)
+	// Otherwise, double-hash the b58-encoded multihash.
+	setCidModernInput(lh, mh)
+	status, entry = dl.checkDoubleHash(idx, lh, inputModern)
 	return StatusResponse{
 		Cid:      c,
 		Status:   status,
 		Filename: dl.Filename,
 		Entry:    entry,
-		Error:    err,
 	}
 }
@@ -0,0 +1,818 @@
+package nopfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	testCid1 = cid.MustParse("bafybeihvvulpp4evxj7x7armbqcyg6uezzuig6jp3lktpbovlqfkuqeuoq")
+	testCid2 = cid.MustParse("QmdWFA9FL52hx3j9EJZPQP1ZUH8Ygi5tLCX2cRDs6knSf8")
+	testCid3 = cid.MustParse("Qmah2YDTfrox4watLCr3YgKyBwvjq8FJZEFdWY6WtJ3Xt2")
+)
+
+func writeTestDenylist(t *testing.T, fpath, content string) {
+	t.Helper()
+	if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForStatus polls the check function until it returns the expected status
+// or times out.
+func waitForStatus(t *testing.T, expected Status, check func() StatusResponse) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := check()
+		if resp.Status == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status %s but got %s", expected, resp)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitForState waits until the denylist has the given header name and
+// reports the given status for every CID.
+func waitForState(t *testing.T, dl *Denylist, name string, expected map[cid.Cid]Status) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dl.mu.RLock()
+		ok := dl.Header.Name == name
+		dl.mu.RUnlock()
+		for c, st := range expected {
+			ok = ok && dl.IsCidBlocked(c).Status == st
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("denylist did not reach the expected state (%s)", name)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDenylistFollowReload(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fpath, "name: test\n---\n/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid2.String()+"\n")
+
+	dl, err := NewDenylist(fpath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+
+	// Initial parsing happens in the background when following.
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid2) })
+
+	// Append: rules are added.
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("/ipfs/" + testCid3.String() + "\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid3) })
+
+	// Rewrite in place, dropping the first rule: full reload.
+	writeTestDenylist(t, fpath, "name: test\n---\n/ipfs/"+testCid2.String()+"\n/ipfs/"+testCid3.String()+"\n")
+	waitForState(t, dl, "test", map[cid.Cid]Status{
+		testCid1: StatusNotFound,
+		testCid2: StatusBlocked,
+		testCid3: StatusBlocked,
+	})
+
+	// Truncate and write a different header.
+	writeTestDenylist(t, fpath, "name: test2\n---\n/ipfs/"+testCid1.String()+"\n/ipfs/"+testCid2.String()+"\n/ipfs/"+testCid1.String()+"\n")
+	waitForState(t, dl, "test2", map[cid.Cid]Status{
+		testCid1: StatusBlocked,
+		testCid2: StatusBlocked,
+		testCid3: StatusNotFound,
+	})
+
+	// Swap the middle rule for another of the same length, in place:
+	// size, header and last line stay the same.
+	f, err = os.OpenFile(fpath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(len("name: test2\n---\n/ipfs/" + testCid1.String() + "\n/ipfs/"))
+	_, err = f.WriteAt([]byte(testCid3.String()), off)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, dl, "test2", map[cid.Cid]Status{
+		testCid1: StatusBlocked,
+		testCid2: StatusNotFound,
+		testCid3: StatusBlocked,
+	})
+}
+
+func TestDenylistFollowReplace(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.deny")
+	writeTestDenylist(t, fpath, "name: test\n---\n/ipfs/"+testCid1.String()+"\n")
+
+	dl, err := NewDenylist(fpath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	waitForState(t, dl, "test", map[cid.Cid]Status{
+		testCid1: StatusBlocked,
+	})
+
+	// Editor-style save: write a new file and rename it on top.
+	tmpPath := filepath.Join(dir, "test.deny.tmp")
+	writeTestDenylist(t, tmpPath, "name: replaced\n---\n/ipfs/"+testCid2.String()+"\n")
+	if err := os.Rename(tmpPath, fpath); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, dl, "replaced", map[cid.Cid]Status{
+		testCid1: StatusNotFound,
+		testCid2: StatusBlocked,
+	})
+
+	// Rules keep working while the file is gone, and a new file is
+	// picked up when it appears.
+	if err := os.Remove(fpath); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if resp := dl.IsCidBlocked(testCid2); resp.Status != StatusBlocked {
+		t.Errorf("cid2 should still be blocked: %s", resp)
+	}
+	writeTestDenylist(t, fpath, "name: recreated\n---\n/ipfs/"+testCid3.String()+"\n")
+	waitForState(t, dl, "recreated", map[cid.Cid]Status{
+		testCid2: StatusNotFound,
+		testCid3: StatusBlocked,
+	})
+
+	// Appending to the new file still works.
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("/ipfs/" + testCid1.String() + "\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid1) })
+}
+
+type testReader struct {
+	*strings.Reader
+}
+
+func (r testReader) Close() error {
+	return nil
+}
+
+func newTestDenylist(t *testing.T, content string, opts ...Option) *Denylist {
+	t.Helper()
+	dl, err := NewDenylistReader(testReader{strings.NewReader(content)}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dl
+}
+
+func TestGatewayStatus(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dl := newTestDenylist(t, `hints:
+  gateway_status: 451
+---
+/ipfs/`+testCid1.String()+`
+/ipfs/`+testCid2.String()+` gateway_status=410
+/ipfs/`+testCid3.String()+` gateway_status=200
+`)
+
+	for c, code := range map[cid.Cid]int{
+		testCid1: 451,
+		testCid2: 410,
+		testCid3: DefaultBlockedHTTPStatus,
+	} {
+		resp := dl.IsCidBlocked(c)
+		if resp.HTTPStatus() != code {
+			t.Errorf("%s: expected %d, got %d", c, code, resp.HTTPStatus())
+		}
+		if err := resp.ToError(); err == nil || err.HTTPStatus() != code {
+			t.Errorf("%s: expected error with status %d", c, code)
+		}
+	}
+
+	resp := dl.IsCidBlocked(cid.MustParse("QmesfgDQ3q6prBy2Kg2gKbW4MAGuWiRP2DVuGA5MZSERLo"))
+	if resp.HTTPStatus() != 451 { // same multihash as testCid1
+		t.Errorf("expected 451, got %d", resp.HTTPStatus())
+	}
+	resp = dl.IsCidBlocked(cid.MustParse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"))
+	if resp.HTTPStatus() != 200 {
+		t.Errorf("expected 200, got %d", resp.HTTPStatus())
+	}
+}
+
+func TestEntryHints(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dl := newTestDenylist(t, `hints:
+  gateway_status: 451
+  category: spam
+---
+/ipfs/`+testCid1.String()+`
+/ipfs/`+testCid2.String()+` gateway_status=410 reason=x
+`)
+
+	e1 := dl.IsCidBlocked(testCid1).Entry
+	e2 := dl.IsCidBlocked(testCid2).Entry
+	if e1.RuleHints != nil {
+		t.Errorf("expected no rule hints, got %v", e1.RuleHints)
+	}
+	if v, ok := e1.Hint(HintGatewayStatus); !ok || v != "451" {
+		t.Errorf("expected the header hint, got %q", v)
+	}
+	if v, _ := e2.Hint(HintGatewayStatus); v != "410" {
+		t.Errorf("expected the rule hint to override the header, got %q", v)
+	}
+	if v, _ := e2.Hint(HintCategory); v != "spam" {
+		t.Errorf("expected the header hint, got %q", v)
+	}
+	if _, ok := e2.Hint("other"); ok {
+		t.Error("unexpected hint")
+	}
+
+	hints := e2.EffectiveHints()
+	if len(hints) != 3 || hints[HintGatewayStatus] != "410" || hints["reason"] != "x" {
+		t.Errorf("unexpected effective hints: %v", hints)
+	}
+	// The returned map is a copy.
+	hints[HintCategory] = "other"
+	if v, _ := e1.Hint(HintCategory); v != "spam" {
+		t.Error("effective hints should not modify the header")
+	}
+}
+
+func TestDoubleHashHints(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	// Double-hash of testCid1 with blake3, hex-encoded.
+	mh, err := multihash.Sum([]byte(testCid1.Hash().B58String()), multihash.BLAKE3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blake3Hex := hex.EncodeToString(dmh.Digest)
+
+	l := &countingLogger{Logger: logging.Logger("nopfs")}
+	dl := newTestDenylist(t, `hints:
+  double_hash_fn: sha256
+  double_hash_enc: hex
+---
+# sha256(bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e/)
+//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7
+# base58btc-sha256-multihash(QmVTF1yEejXd9iMgoRTFDxBv7HAz9kuZcQNBzHrceuK9HR)
+//QmX9dhRcQcKUw3Ws8485T5a9dtjrSCQaUAHnG4iK9i4ceM double_hash_enc=b58
+//`+blake3Hex+` double_hash_fn=blake3
+//QmX9dhRcQcKUw3Ws8485T5a9dtjrSCQaUAHnG4iK9i4ceM double_hash_enc=b58 double_hash_fn=blake3
+//abcd double_hash_enc=b64
+//QmbK7LDv5NNBvYQzNfm2eED17SNLt1yNMapcUhSuNLgkqz
+`, WithLogger(l))
+
+	blocked := []cid.Cid{
+		cid.MustParse("bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e"),
+		cid.MustParse("QmVTF1yEejXd9iMgoRTFDxBv7HAz9kuZcQNBzHrceuK9HR"),
+		testCid1,
+	}
+	for _, c := range blocked {
+		if resp := dl.IsCidBlocked(c); resp.Status != StatusBlocked {
+			t.Errorf("%s should be blocked: %s", c, resp)
+		}
+	}
+
+	// With hints, a single interpretation per rule is stored.
+	if n := len(dl.DoubleHashBlocksDB); n != 2 {
+		t.Errorf("expected sha256 and blake3 double-hash dbs, got %d", n)
+	}
+	if n := len(dl.Entries); n != 3 {
+		t.Errorf("expected 3 valid rules, got %d", n)
+	}
+	// Valid rules that do not match the hints are dropped with a
+	// warning.
+	if l.warnings != 2 {
+		t.Errorf("expected 2 warnings, got %d", l.warnings)
+	}
+}
+
+func TestBlockedPathGlob(t *testing.T) {
+	for _, tc := range []struct {
+		rule    string
+		path    string
+		matches bool
+	}{
+		{"*.exe", "setup.exe", true},
+		{"*.exe", "a/setup.exe", false},
+		{"**.exe", "a/setup.exe", true},
+		{"**/index.html", "index.html", true},
+		{"**/index.html", "a/b/index.html", true},
+		{"**/index.html", "a/b/myindex.html", false},
+		{"*/wp-login.php", "blog/wp-login.php", true},
+		{"*/wp-login.php", "wp-login.php", false},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/b/c", false},
+		{"a/**/c", "a/b/b/c", true},
+		{"a/*b/*", "a/xb/anything/else", true}, // trailing * is a prefix
+		{"a/*b/*", "a/xc/anything", false},
+		{"a%2A/*.txt", "a*/f.txt", true},
+		{"a%2A/*.txt", "ab/f.txt", false},
+		{"a/**/**/c", "a/c", true},
+		{"**/b/**/d", "a/b/c/d", true},
+		{"**/b/**/d", "a/bb/c/d", false},
+		{"*a*a*", "xaya", true},
+		{"*a*a*", "xa/ya", false},
+		{"**a**b", "aaab", true},
+		{"**a**b", "aaaa", false},
+	} {
+		bp, err := NewBlockedPath(tc.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bp.Matches(tc.path) != tc.matches {
+			t.Errorf("%s matching %s should be %t", tc.rule, tc.path, tc.matches)
+		}
+	}
+}
+
+func TestBlockedPathGlobPathological(t *testing.T) {
+	// A backtracking matcher takes exponential time with these.
+	path := strings.Repeat("a", 200)
+	for _, rule := range []string{
+		"**a**a**a**a**a**b",
+		"*a*a*a*a*a*a*a*a*b",
+		"**/**/**/**/**/**/b",
+	} {
+		bp, err := NewBlockedPath(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if bp.Matches(path) {
+			t.Errorf("%s should not match", rule)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s took %s", rule, d)
+		}
+	}
+}
+
+func TestDenylistGlobRules(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dl := newTestDenylist(t, `/ipfs/`+testCid1.String()+`/**/index.html
+/ipns/*/wp-login.php
+**.exe
+**/private/*
++**/private/public.txt
+`)
+
+	for _, tc := range []struct {
+		path     string
+		expected Status
+	}{
+		{"/ipfs/" + testCid1.String() + "/index.html", StatusBlocked},
+		{"/ipfs/" + testCid1.String() + "/a/b/index.html", StatusBlocked},
+		{"/ipfs/" + testCid2.String() + "/index.html", StatusNotFound},
+		{"/ipns/example.com/wp-login.php", StatusBlocked},
+		{"/ipns/example.com/blog/wp-login.php", StatusNotFound},
+		{"/ipfs/" + testCid2.String() + "/a/setup.exe", StatusBlocked},
+		{"/ipfs/" + testCid2.String() + "/a/setup.exe.txt", StatusNotFound},
+		{"/ipfs/" + testCid2.String() + "/private/secret.txt", StatusBlocked},
+		{"/ipfs/" + testCid2.String() + "/a/private/public.txt", StatusAllowed},
+	} {
+		p, err := path.NewPath(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := dl.IsPathBlocked(p); resp.Status != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.path, tc.expected, resp)
+		}
+	}
+}
+
+func BenchmarkGlobIndex(b *testing.B) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	var sb strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&sb, "**/file%d.txt\n", i)
+	}
+	dl, err := NewDenylistReader(testReader{strings.NewReader(sb.String())})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dl.IsSubpathBlocked("a/b/c/file9999.txt")
+	}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+func TestExpiringRules(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dl := newTestDenylist(t, `hints:
+  expires: 2024-03-01T00:00:00Z
+---
+/ipfs/`+testCid1.String()+` expires=2024-02-01T00:00:00Z
+/ipfs/`+testCid2.String()+`
+/ipfs/`+testCid3.String()+` not_before=2024-01-15T00:00:00Z expires=2024-06-01T00:00:00Z
+/ipfs/`+testCid3.String()+` expires=wrong
+`, WithClock(clock.Now))
+
+	if n := len(dl.Entries); n != 3 {
+		t.Fatalf("expected 3 valid rules, got %d", n)
+	}
+
+	for _, tc := range []struct {
+		now      time.Time
+		expected map[cid.Cid]Status
+	}{
+		{time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC), map[cid.Cid]Status{
+			testCid1: StatusBlocked,
+			testCid2: StatusBlocked,
+			testCid3: StatusNotFound,
+		}},
+		{time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC), map[cid.Cid]Status{
+			testCid1: StatusBlocked,
+			testCid2: StatusBlocked,
+			testCid3: StatusBlocked,
+		}},
+		{time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC), map[cid.Cid]Status{
+			testCid1: StatusNotFound,
+			testCid2: StatusBlocked,
+			testCid3: StatusBlocked,
+		}},
+		{time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), map[cid.Cid]Status{
+			testCid1: StatusNotFound,
+			testCid2: StatusNotFound,
+			testCid3: StatusBlocked, // rule hint overrides header
+		}},
+	} {
+		clock.Set(tc.now)
+		for c, st := range tc.expected {
+			if resp := dl.IsCidBlocked(c); resp.Status != st {
+				t.Errorf("%s: %s: expected %s, got %s", tc.now, c, st, resp)
+			}
+		}
+	}
+
+	// Expired rules are eventually removed.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dl.mu.RLock()
+		n := len(dl.Entries)
+		_, found := dl.IPFSBlocksDB.Load(string(testCid1.Hash()))
+		dl.mu.RUnlock()
+		if n == 1 && !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired rules were not removed (%d rules left)", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestExpiringRulesSharedTime(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dl := newTestDenylist(t, `hints:
+  expires: 2024-03-01T00:00:00Z
+---
+/ipfs/`+testCid1.String()+`
+/ipfs/`+testCid2.String()+`
+/ipfs/`+testCid3.String()+` expires=2024-03-01T00:00:00Z
+`, WithClock(clock.Now))
+
+	// The header expiration time is recorded once, not per rule.
+	dl.mu.RLock()
+	n := len(dl.expiries)
+	dl.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("expected 1 expiration time, got %d", n)
+	}
+
+	clock.Set(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+	for _, c := range []cid.Cid{testCid1, testCid2, testCid3} {
+		if resp := dl.IsCidBlocked(c); resp.Status != StatusNotFound {
+			t.Errorf("%s: expected %s, got %s", c, StatusNotFound, resp)
+		}
+	}
+}
+
+func TestParallelLoad(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	// Enough lines for several batches, with allow rules overriding
+	// block rules from previous batches and invalid lines.
+	var sb strings.Builder
+	n := 3*parseBatchLines + 10
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&sb, "/ipfs/%s/%d\n", testCid1, i)
+		case 1:
+			fmt.Fprintf(&sb, "-/ipfs/%s/%d\n", testCid1, i-parseBatchLines)
+		default:
+			fmt.Fprintf(&sb, "/ipfs/invalid%d\n", i)
+		}
+	}
+	sb.WriteString("/ipfs/" + testCid2.String()) // partial line
+
+	seqLogger := &countingLogger{Logger: logging.Logger("nopfs")}
+	sequential := newTestDenylist(t, sb.String(), WithParseWorkers(1), WithLogger(seqLogger))
+	parLogger := &countingLogger{Logger: logging.Logger("nopfs")}
+	parallel := newTestDenylist(t, sb.String(), WithParseWorkers(4), WithLogger(parLogger))
+	if parLogger.errors != n/3 || seqLogger.errors != n/3 {
+		t.Errorf("expected %d logged errors, got %d and %d", n/3, seqLogger.errors, parLogger.errors)
+	}
+	if len(parallel.Entries) != len(sequential.Entries) {
+		t.Fatalf("expected %d entries, got %d", len(sequential.Entries), len(parallel.Entries))
+	}
+	for i, e := range parallel.Entries {
+		if e.Line != sequential.Entries[i].Line || e.RawValue != sequential.Entries[i].RawValue {
+			t.Fatalf("entry %d differs: %s vs. %s", i, e, sequential.Entries[i])
+		}
+	}
+
+	for i := 0; i < n; i += 3 {
+		p, err := path.NewPath(fmt.Sprintf("/ipfs/%s/%d", testCid1, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := sequential.IsPathBlocked(p).Status
+		if resp := parallel.IsPathBlocked(p); resp.Status != expected {
+			t.Errorf("%s: expected %s, got %s", p, expected, resp)
+		}
+	}
+	if resp := parallel.IsCidBlocked(testCid2); resp.Status != StatusNotFound {
+		t.Errorf("partial lines should not be parsed: %s", resp)
+	}
+
+	// The first error is reported with a strict policy.
+	_, err := NewDenylistReader(testReader{strings.NewReader(sb.String())}, WithParseWorkers(4), WithErrorPolicy(ErrorPolicyStrict))
+	if err == nil || !strings.Contains(err.Error(), ":3)") {
+		t.Errorf("expected an error for line 3, got %v", err)
+	}
+
+	// But not for lines appended while following.
+	dl, err := newDenylist("", testReader{strings.NewReader("/ipfs/wrong\n/ipfs/" + testCid1.String() + "\n")},
+		newConfig([]Option{WithParseWorkers(4), WithErrorPolicy(ErrorPolicyStrict)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	err = dl.followLines(newLineReader(dl.f, 0, 0), func() error { return errDenylistClosed })
+	if err != nil {
+		t.Fatalf("appended errors should not be fatal: %s", err)
+	}
+	if resp := dl.IsCidBlocked(testCid1); resp.Status != StatusBlocked {
+		t.Errorf("appended rules should be loaded: %s", resp)
+	}
+}
+
+func BenchmarkLoadDenylist(b *testing.B) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "/ipfs/%s\n", cid.NewCidV1(cid.Raw, bloomTestKey(i)))
+	}
+	list := sb.String()
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := NewDenylistReader(testReader{strings.NewReader(list)}, WithParseWorkers(workers)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestDenylistConcurrentUpdates checks that lookups see consistent rules
+// while a followed denylist is appended to and replaced. Run with -race.
+func TestDenylistConcurrentUpdates(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	// Rules in every version of the file: testCid1 and testCid3/* are
+	// blocked, testCid2 is blocked and then allowed.
+	base := "name: test\n---\n/ipfs/" + testCid1.String() + "\n/ipfs/" + testCid3.String() + "/*\n" +
+		"/ipfs/" + testCid2.String() + "\n-/ipfs/" + testCid2.String() + "\n"
+	blockedPath, err := path.NewPath("/ipfs/" + testCid3.String() + "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"memory", nil},
+		{"disk", []Option{WithBlocksDB(DiskBlocksDBFactory(t.TempDir()))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fpath := filepath.Join(dir, "test.deny")
+			writeTestDenylist(t, fpath, base)
+
+			dl, err := NewDenylist(fpath, true, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dl.Close()
+			waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid1) })
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if resp := dl.IsCidBlocked(testCid1); resp.Status != StatusBlocked {
+							t.Errorf("%s should always be blocked: %s", testCid1, resp)
+							return
+						}
+						if resp := dl.IsCidBlocked(testCid2); resp.Status == StatusBlocked {
+							t.Errorf("%s should never be blocked: %s", testCid2, resp)
+							return
+						}
+						if resp := dl.IsPathBlocked(blockedPath); resp.Status != StatusBlocked {
+							t.Errorf("%s should always be blocked: %s", blockedPath, resp)
+							return
+						}
+					}
+				}()
+			}
+
+			// Append rules, and every so often replace the file with
+			// the base rules, which triggers a full reload.
+			var last cid.Cid
+			for i := 0; i < 100; i++ {
+				if i%25 == 12 {
+					tmpPath := fpath + ".tmp"
+					writeTestDenylist(t, tmpPath, base)
+					if err := os.Rename(tmpPath, fpath); err != nil {
+						t.Fatal(err)
+					}
+					waitForStatus(t, StatusNotFound, func() StatusResponse { return dl.IsCidBlocked(last) })
+					continue
+				}
+				last = cid.NewCidV1(cid.Raw, bloomTestKey(i))
+				f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = f.WriteString("/ipfs/" + last.String() + "\n")
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(last) })
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestDenylistCloseDuringLookups(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"memory", nil},
+		{"disk", []Option{WithBlocksDB(DiskBlocksDBFactory(t.TempDir()))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dl := newTestDenylist(t, "/ipfs/"+testCid1.String()+"\n", tc.opts...)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						dl.IsCidBlocked(testCid1)
+					}
+				}()
+			}
+			time.Sleep(10 * time.Millisecond)
+			if err := dl.Close(); err != nil {
+				t.Error(err)
+			}
+
+			// The BlocksDBs are closed, and lookups no longer use
+			// them.
+			if resp := dl.IsCidBlocked(testCid1); resp.Status != StatusNotFound {
+				t.Errorf("closed denylists should not block: %s", resp)
+			}
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestDenylistIndexesWaitReaders(t *testing.T) {
+	dl := &Denylist{}
+	dl.publish()
+	idx := dl.acquireIndexes()
+	old := dl.publish()
+	if old != idx {
+		t.Fatal("expected the acquired set to be retired")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		old.waitReaders()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("waitReaders returned while the set is in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dl.releaseIndexes(idx)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitReaders did not return after the set was released")
+	}
+
+	// Sets without readers are not waited for.
+	dl.publish().waitReaders()
+}
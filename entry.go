@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/multiformats/go-multihash"
 )
@@ -13,10 +14,20 @@ import (
 type Entry struct {
 	Line      uint64
 	AllowRule bool
-	Hints     map[string]string
+	// RuleHints contains the hints set in the rule itself (nil when
+	// none). Hints set in the header of the denylist apply too, unless
+	// overridden by the rule: use Hint() or EffectiveHints() to take
+	// them into account.
+	RuleHints map[string]string
 	RawValue  string
 	Multihash multihash.Multihash // set for ipfs-paths mostly.
 	Path      BlockedPath
+	NotBefore time.Time // set by the not_before hint.
+	Expires   time.Time // set by the expires hint.
+
+	// headerHints are the hints in the header of the denylist, shared
+	// by all its entries.
+	headerHints map[string]string
 }
 
 // String provides a single-line representation of the Entry.
@@ -28,32 +39,113 @@ func (e Entry) String() string {
 	return fmt.Sprintf("Path: %s. Prefix: %t. AllowRule: %t.", path, e.Path.Prefix, e.AllowRule)
 }
 
+// Clone returns a copy of the Entry. The header hints are shared, as they
+// are never modified.
 func (e Entry) Clone() Entry {
-	hints := make(map[string]string, len(e.Hints))
-	for k, v := range e.Hints {
-		hints[k] = v
+	var hints map[string]string
+	if e.RuleHints != nil {
+		hints = make(map[string]string, len(e.RuleHints))
+		for k, v := range e.RuleHints {
+			hints[k] = v
+		}
 	}
 
 	return Entry{
-		Line:      e.Line,
-		AllowRule: e.AllowRule,
-		Hints:     hints,
-		RawValue:  e.RawValue,
-		Multihash: bytes.Clone(e.Multihash),
-		Path:      e.Path,
+		Line:        e.Line,
+		AllowRule:   e.AllowRule,
+		RuleHints:   hints,
+		RawValue:    e.RawValue,
+		Multihash:   bytes.Clone(e.Multihash),
+		Path:        e.Path,
+		NotBefore:   e.NotBefore,
+		Expires:     e.Expires,
+		headerHints: e.headerHints,
+	}
+}
+
+// Hint returns the value of a hint for the Entry, as set in the rule or,
+// otherwise, in the header of the denylist.
+func (e Entry) Hint(key string) (string, bool) {
+	if v, ok := e.RuleHints[key]; ok {
+		return v, true
+	}
+	v, ok := e.headerHints[key]
+	return v, ok
+}
+
+// EffectiveHints returns a new map with all the hints that apply to the
+// Entry, from the header of the denylist and from the rule.
+func (e Entry) EffectiveHints() map[string]string {
+	hints := make(map[string]string, len(e.headerHints)+len(e.RuleHints))
+	for k, v := range e.headerHints {
+		hints[k] = v
+	}
+	for k, v := range e.RuleHints {
+		hints[k] = v
+	}
+	return hints
+}
+
+// timed returns true when the Entry is only valid during a time window.
+func (e Entry) timed() bool {
+	return !e.NotBefore.IsZero() || !e.Expires.IsZero()
+}
+
+// ActiveAt returns whether the Entry applies at the given time, per its
+// not_before and expires hints.
+func (e Entry) ActiveAt(t time.Time) bool {
+	if !e.NotBefore.IsZero() && t.Before(e.NotBefore) {
+		return false
+	}
+	if !e.Expires.IsZero() && !t.Before(e.Expires) {
+		return false
+	}
+	return true
+}
+
+// ExpiredAt returns whether the Entry has expired at the given time.
+func (e Entry) ExpiredAt(t time.Time) bool {
+	return !e.Expires.IsZero() && !t.Before(e.Expires)
+}
+
+// nextChange returns the first time after t at which the Entry becomes
+// active or inactive, or zero if it does not change after t.
+func (e Entry) nextChange(t time.Time) time.Time {
+	if !e.NotBefore.IsZero() && t.Before(e.NotBefore) {
+		return e.NotBefore
 	}
+	if !e.Expires.IsZero() && t.Before(e.Expires) {
+		return e.Expires
+	}
+	return time.Time{}
 }
 
 // Entries is a slice of Entry.
 type Entries []Entry
 
-// CheckPathStatus returns whether the given path has a match in one of the Entries.
+// CheckPathStatus returns whether the given path has a match in one of the
+// Entries. Entries that are not active now (see Entry.ActiveAt) are ignored.
 func (entries Entries) CheckPathStatus(p string) (Status, Entry) {
+	return entries.checkPathStatus(p, func(e Entry) bool {
+		return e.timed() && !e.ActiveAt(time.Now())
+	})
+}
+
+// CheckPathStatusAt works like CheckPathStatus but ignores Entries that are
+// not active at the given time.
+func (entries Entries) CheckPathStatusAt(p string, t time.Time) (Status, Entry) {
+	return entries.checkPathStatus(p, func(e Entry) bool {
+		return !e.ActiveAt(t)
+	})
+}
+
+// checkPathStatus returns whether the given path has a match in one of the
+// Entries, ignoring those for which skip returns true.
+func (entries Entries) checkPathStatus(p string, skip func(Entry) bool) (Status, Entry) {
 	// start by the last one, since latter items have preference.
 	for i := len(entries) - 1; i >= 0; i-- {
 		e := entries[i]
-		logger.Debugf("check-path: %s matches %s", e.Path.Path, p)
-		if e.Path.Matches(p) {
+		if e.Path.Matches(p) && !skip(e) {
 			// if we find a negative rule that matches the path
 			// then it is not blocked.
 			if e.AllowRule {
@@ -65,10 +157,48 @@ func (entries Entries) CheckPathStatus(p string) (Status, Entry) {
 	return StatusNotFound, Entry{}
 }
 
+// appendMatches appends the Entries that match the given path to dst,
+// ignoring those for which skip returns true, and returns it.
+func (entries Entries) appendMatches(dst Entries, p string, skip func(Entry) bool) Entries {
+	for _, e := range entries {
+		if e.Path.Matches(p) && !skip(e) {
+			dst = append(dst, e)
+		}
+	}
+	return dst
+}
+
+// removeExpired returns the Entries that have not expired at the given time
+// and the number of Entries removed. The original slice is not modified.
+func (entries Entries) removeExpired(t time.Time) (Entries, int) {
+	var kept Entries
+	for _, e := range entries {
+		if !e.ExpiredAt(t) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, len(entries) - len(kept)
+}
+
 // BlockedPath represents the path part of a blocking rule.
+//
+// Paths can contain wildcards:
+//
+//   - A "*" at the end of the path (or a "/*") makes it a prefix: it
+//     matches anything starting with the rest of the path, including
+//     further subpaths.
+//   - A "*" anywhere else matches any sequence of characters within a path
+//     segment (it does not match "/"). e.g. "*.exe".
+//   - A "**" matches any sequence of characters, including "/". A "**/"
+//     matches any number of path segments, including none. e.g.
+//     "**/index.html".
+//
+// Wildcards can be escaped as "%2A" to match a literal "*".
 type BlockedPath struct {
 	Path   string
 	Prefix bool
+
+	glob []globToken
 }
 
 // NewBlockedPath takes a raw path, unscapes and sanitizes it, detecting and
@@ -93,6 +223,22 @@ func NewBlockedPath(rawPath string) (BlockedPath, error) {
 		prefix = true
 	}
 
+	rawPath = strings.TrimPrefix(rawPath, "/")
+	rawPath = strings.TrimSuffix(rawPath, "/")
+
+	// Wildcards in the middle.
+	if strings.Contains(rawPath, "*") {
+		glob, path, err := parseGlob(rawPath)
+		if err != nil {
+			return BlockedPath{}, err
+		}
+		return BlockedPath{
+			Path:   path,
+			Prefix: prefix,
+			glob:   glob,
+		}, nil
+	}
+
 	path, err := url.QueryUnescape(rawPath)
 	if err != nil {
 		return BlockedPath{}, err
@@ -107,12 +253,22 @@ func NewBlockedPath(rawPath string) (BlockedPath, error) {
 	}, nil
 }
 
+// IsGlob returns true when the path contains wildcards other than a
+// trailing one.
+func (bpath BlockedPath) IsGlob() bool {
+	return len(bpath.glob) > 0
+}
+
 // Matches returns whether the given path matched the blocked (or allowed) path.
 func (bpath BlockedPath) Matches(path string) bool {
 	// sanitize path
 	path = strings.TrimSuffix(path, "/")
 	path = strings.TrimPrefix(path, "/")
 
+	if bpath.glob != nil {
+		return matchGlob(bpath.glob, path, bpath.Prefix)
+	}
+
 	// Matches all paths
 	if bpath.Path == "*" {
 		return true
@@ -134,3 +290,148 @@ func (bpath BlockedPath) Matches(path string) bool {
 
 	return false
 }
+
+type globTokenType int
+
+const (
+	globLiteral    globTokenType = iota
+	globStar                     // * : anything but /
+	globDoubleStar               // ** : anything
+	globAnyDirs                  // **/ : nothing or anything ending in /
+)
+
+type globToken struct {
+	typ     globTokenType
+	literal string
+}
+
+// parseGlob splits a raw (escaped) path with wildcards into tokens,
+// unescaping the literal parts. It also returns a human-readable
+// representation of the pattern.
+func parseGlob(rawPath string) ([]globToken, string, error) {
+	var tokens []globToken
+	var readable strings.Builder
+
+	for len(rawPath) > 0 {
+		i := strings.IndexByte(rawPath, '*')
+		if i < 0 {
+			i = len(rawPath)
+		}
+		if i > 0 {
+			lit, err := url.QueryUnescape(rawPath[:i])
+			if err != nil {
+				return nil, "", err
+			}
+			tokens = append(tokens, globToken{typ: globLiteral, literal: lit})
+			readable.WriteString(lit)
+			rawPath = rawPath[i:]
+			continue
+		}
+
+		// we have a wildcard
+		switch {
+		case strings.HasPrefix(rawPath, "**/"):
+			tokens = append(tokens, globToken{typ: globAnyDirs})
+			readable.WriteString("**/")
+			rawPath = rawPath[3:]
+		case strings.HasPrefix(rawPath, "**"):
+			tokens = append(tokens, globToken{typ: globDoubleStar})
+			readable.WriteString("**")
+			rawPath = strings.TrimLeft(rawPath, "*")
+		default:
+			tokens = append(tokens, globToken{typ: globStar})
+			readable.WriteString("*")
+			rawPath = rawPath[1:]
+		}
+	}
+	return tokens, readable.String(), nil
+}
+
+// matchGlob returns whether the path matches the given tokens. When prefix
+// is true, anything may follow the pattern.
+//
+// Rather than backtracking, which takes exponential time with many
+// wildcards, it tracks the set of positions in the path that the tokens
+// matched so far can end at, so it takes O(len(tokens) * len(path)).
+func matchGlob(tokens []globToken, path string, prefix bool) bool {
+	n := len(path)
+	var buf [2][keyBufferSize + 1]bool
+	var cur, next []bool
+	if n < keyBufferSize {
+		cur, next = buf[0][:n+1], buf[1][:n+1]
+	} else {
+		cur, next = make([]bool, n+1), make([]bool, n+1)
+	}
+	cur[0] = true
+
+	for _, tk := range tokens {
+		matched := false
+		switch tk.typ {
+		case globLiteral:
+			for i := range next {
+				next[i] = false
+			}
+			for i := 0; i+len(tk.literal) <= n; i++ {
+				if cur[i] && path[i:i+len(tk.literal)] == tk.literal {
+					next[i+len(tk.literal)] = true
+					matched = true
+				}
+			}
+		case globStar:
+			// Anything from a reachable position up to the next /.
+			reach := false
+			for i := 0; i <= n; i++ {
+				reach = reach || cur[i]
+				next[i] = reach
+				matched = matched || reach
+				if i < n && path[i] == '/' {
+					reach = false
+				}
+			}
+		case globDoubleStar:
+			reach := false
+			for i := 0; i <= n; i++ {
+				reach = reach || cur[i]
+				next[i] = reach
+				matched = matched || reach
+			}
+		case globAnyDirs:
+			// The same position, or right after any / following
+			// a reachable position.
+			reach := false
+			for i := 0; i <= n; i++ {
+				next[i] = cur[i] || (reach && path[i-1] == '/')
+				reach = reach || cur[i]
+				matched = matched || next[i]
+			}
+		}
+		if !matched {
+			return false
+		}
+		cur, next = next, cur
+	}
+
+	if prefix {
+		return true // some position is reachable
+	}
+	return cur[n]
+}
+
+// indexSuffix returns the literal part of the pattern after the last
+// wildcard and last "/", which must be a suffix of the last segment of any
+// matching path. It returns "" when no such suffix exists (i.e. the pattern
+// ends with a wildcard or it is a prefix).
+func (bpath BlockedPath) indexSuffix() string {
+	if bpath.Prefix || len(bpath.glob) == 0 {
+		return ""
+	}
+	last := bpath.glob[len(bpath.glob)-1]
+	if last.typ != globLiteral {
+		return ""
+	}
+	lit := last.literal
+	if i := strings.LastIndexByte(lit, '/'); i >= 0 {
+		lit = lit[i+1:]
+	}
+	return lit
+}
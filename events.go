@@ -0,0 +1,163 @@
+package nopfs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+// EventType values.
+const (
+	// EventRuleAdded is sent for every rule added to a followed
+	// denylist after it has been loaded (i.e. appended to the file).
+	// Rules in the file when it is loaded or reloaded are not sent
+	// one by one.
+	EventRuleAdded EventType = iota
+	// EventDenylistLoaded is sent when the rules that a denylist file
+	// contains have been loaded, when it is opened.
+	EventDenylistLoaded
+	// EventDenylistReloaded is sent when a followed denylist file has
+	// been modified other than by appending to it (or replaced) and its
+	// rules have been replaced by the new ones.
+	EventDenylistReloaded
+	// EventDenylistRemoved is sent when a denylist is removed from a
+	// Blocker (see Blocker.RemoveDenylist() and NewDirBlocker()).
+	EventDenylistRemoved
+	// EventParseError is sent for rules that cannot be parsed and are
+	// skipped.
+	EventParseError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRuleAdded:
+		return "rule added"
+	case EventDenylistLoaded:
+		return "denylist loaded"
+	case EventDenylistReloaded:
+		return "denylist reloaded"
+	case EventDenylistRemoved:
+		return "denylist removed"
+	case EventParseError:
+		return "parse error"
+	}
+	return "unknown"
+}
+
+// Event is a change in the denylists of a Blocker, as received by
+// Subscriptions.
+type Event struct {
+	Type     EventType
+	Filename string
+	// Entry is the rule added, for EventRuleAdded.
+	Entry Entry
+	// Err is the error, for EventParseError.
+	Err error
+}
+
+// String provides a string with the details of an Event.
+func (ev Event) String() string {
+	switch ev.Type {
+	case EventRuleAdded:
+		return fmt.Sprintf("%s: %s (%s:%d)", ev.Type, ev.Entry.RawValue, ev.Filename, ev.Entry.Line)
+	case EventParseError:
+		return fmt.Sprintf("%s: %s", ev.Type, ev.Err)
+	}
+	return fmt.Sprintf("%s: %s", ev.Type, ev.Filename)
+}
+
+// EventSubscription receives the Events of the denylists of a Blocker (see
+// Blocker.Subscribe()).
+//
+// Events are not sent when the EventSubscription is not keeping up with
+// them: its buffer is full. They are counted instead (see Dropped()), and
+// integrators should assume that anything may have changed then.
+type EventSubscription struct {
+	// Accessed atomically. First in the struct for alignment.
+	dropped uint64
+
+	c   chan Event
+	bus *eventBus
+}
+
+// Events returns the channel on which Events are received. It is closed
+// when the EventSubscription is closed.
+func (s *EventSubscription) Events() <-chan Event {
+	return s.c
+}
+
+// Dropped returns the number of Events that could not be received because
+// the buffer of the EventSubscription was full.
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops receiving Events and closes the Events channel.
+func (s *EventSubscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// eventBus sends Events to Subscriptions. It is shared by the denylists of
+// a Blocker (nil for standalone denylists).
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*EventSubscription]struct{}),
+	}
+}
+
+func (b *eventBus) subscribe(buffer int) *EventSubscription {
+	s := &EventSubscription{
+		c:   make(chan Event, buffer),
+		bus: b,
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *EventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.c)
+}
+
+// emit sends an Event to all Subscriptions, without waiting for them. It
+// can be called on a nil eventBus.
+func (b *eventBus) emit(ev Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		select {
+		case s.c <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns an EventSubscription to the Events of the denylists of
+// the Blocker: rules added to followed denylists, denylists loaded,
+// reloaded or removed and rules that cannot be parsed. It can be used to
+// purge state derived from lookups (i.e. caches of content that is now
+// blocked) when rules change. Events are buffered up to the given number,
+// and dropped when the buffer is full. The EventSubscription should be
+// closed when no longer needed.
+func (blocker *Blocker) Subscribe(buffer int) *EventSubscription {
+	return blocker.cfg.events.subscribe(buffer)
+}
@@ -0,0 +1,106 @@
+package nopfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// waitForEvent returns the next event of the given type for the given
+// denylist, skipping others.
+func waitForEvent(t *testing.T, sub *EventSubscription, typ EventType, fname string) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if ev.Type == typ && ev.Filename == fname {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event for %s", typ, fname)
+		}
+	}
+}
+
+func TestBlockerEvents(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.deny")
+	writeTestDenylist(t, a, "/ipfs/"+testCid1.String()+"\n")
+	b := filepath.Join(dir, "b.deny")
+	writeTestDenylist(t, b, "/ipfs/"+testCid2.String()+"\n")
+
+	blocker, err := NewBlocker([]string{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	sub := blocker.Subscribe(100)
+	defer sub.Close()
+
+	if err := blocker.AddDenylistFile(b); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, sub, EventDenylistLoaded, b)
+
+	// Appended rules are announced, as are those that cannot be
+	// parsed.
+	f, err := os.OpenFile(b, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("/ipfs/" + testCid3.String() + "\n/ipfs/invalid\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := waitForEvent(t, sub, EventRuleAdded, b)
+	if ev.Entry.Line != 2 || ev.Entry.RawValue != "/ipfs/"+testCid3.String() {
+		t.Errorf("unexpected entry: %s", ev)
+	}
+	if ev := waitForEvent(t, sub, EventParseError, b); ev.Err == nil {
+		t.Errorf("expected an error: %s", ev)
+	}
+
+	// Rules of reloads are not announced one by one.
+	tmpPath := filepath.Join(dir, "b.tmp")
+	writeTestDenylist(t, tmpPath, "/ipfs/"+testCid1.String()+"\n")
+	if err := os.Rename(tmpPath, b); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, sub, EventDenylistReloaded, b)
+	select {
+	case ev := <-sub.Events():
+		t.Errorf("unexpected event after reloading: %s", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := blocker.RemoveDenylist(b); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, sub, EventDenylistRemoved, b)
+	if n := sub.Dropped(); n != 0 {
+		t.Errorf("expected no dropped events, got %d", n)
+	}
+
+	// Events are dropped rather than waiting for slow subscriptions.
+	slow := blocker.Subscribe(0)
+	if err := blocker.RemoveDenylist(a); err != nil {
+		t.Fatal(err)
+	}
+	if n := slow.Dropped(); n != 1 {
+		t.Errorf("expected 1 dropped event, got %d", n)
+	}
+	slow.Close()
+	if _, ok := <-slow.Events(); ok {
+		t.Error("events channel should be closed")
+	}
+}
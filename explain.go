@@ -0,0 +1,196 @@
+package nopfs
+
+import (
+	"fmt"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// MatchStage is the stage of a lookup at which a rule matches an item.
+// Denylists check the stages in this order and stop at the first one with
+// a matching rule.
+type MatchStage int
+
+// MatchStage values.
+const (
+	// MatchSubpath is for path rules that apply under any CID or name
+	// (i.e. "/some/path" or "/**/*.exe"). Only checked for paths with
+	// a subpath.
+	MatchSubpath MatchStage = iota
+	// MatchDirect is for rules on the CID (multihash) or IPNS name
+	// itself, including IPNS rules for any name ("/ipns/*/path").
+	MatchDirect
+	// MatchLegacyDoubleHash is for legacy (badbits) double-hash rules,
+	// which hash "<cidv1b32>/<path>" with sha2-256.
+	MatchLegacyDoubleHash
+	// MatchDoubleHash is for double-hash rules, which hash
+	// "<b58-multihash>/<path>" with some hashing function.
+	MatchDoubleHash
+)
+
+func (st MatchStage) String() string {
+	switch st {
+	case MatchSubpath:
+		return "subpath"
+	case MatchDirect:
+		return "direct"
+	case MatchLegacyDoubleHash:
+		return "legacy double-hash"
+	case MatchDoubleHash:
+		return "double-hash"
+	}
+	return "unknown"
+}
+
+// Match is a rule that matches an item, as reported by Blocker.ExplainCid()
+// and Blocker.ExplainPath().
+type Match struct {
+	Filename string
+	Stage    MatchStage
+	// HashFunction is the multihash code of the hashing function of
+	// double-hash matches.
+	HashFunction uint64
+	Status       Status // StatusBlocked or StatusAllowed
+	Entry        Entry
+}
+
+// String provides a string with the details of a Match.
+func (m Match) String() string {
+	stage := m.Stage.String()
+	if m.Stage == MatchDoubleHash || m.Stage == MatchLegacyDoubleHash {
+		stage = fmt.Sprintf("%s (%s)", stage, multicodec.Code(m.HashFunction))
+	}
+	return fmt.Sprintf("%s by %s:%d (%s), %s match", m.Status, m.Filename, m.Entry.Line, m.Entry.RawValue, stage)
+}
+
+// Explanation describes how a Blocker decides on an item: the response
+// that IsCidBlocked() or IsPathBlocked() give, and all the rules that match
+// the item.
+type Explanation struct {
+	Decision StatusResponse
+	// Reason describes the rule that makes the decision, if any.
+	Reason string
+	// Matches are the active rules that match the item in all the
+	// denylists, in order of precedence of the denylists, then in the
+	// order of the lookup stages and then by line. Lookups stop at the
+	// first stage with a match, so the rules that only match later are
+	// never checked by them. A rule may appear more than once when it
+	// matches in several stages.
+	Matches []Match
+}
+
+// ExplainCid returns all the rules that match a CID in every denylist, in
+// addition to the decision that IsCidBlocked() takes. It is meant for
+// troubleshooting: unlike IsCidBlocked(), it checks every lookup stage of
+// every denylist and does not use the bloom filter or the cache.
+func (blocker *Blocker) ExplainCid(c cid.Cid) Explanation {
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+
+	var lh lookupHashes
+	decision := blocker.isCidBlocked(c, &lh, nil)
+	x := &explainer{}
+	lh.explain = x
+	for _, dl := range blocker.denylists {
+		dl.isCidBlocked(c, &lh)
+	}
+	return x.explanation(decision)
+}
+
+// ExplainPath returns all the rules that match a path in every denylist,
+// in addition to the decision that IsPathBlocked() takes. See ExplainCid().
+func (blocker *Blocker) ExplainPath(p path.Path) Explanation {
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+
+	var lh lookupHashes
+	decision := blocker.isPathBlocked(p, &lh)
+	x := &explainer{}
+	lh.explain = x
+	for _, dl := range blocker.denylists {
+		dl.isPathBlocked(p, &lh)
+	}
+	return x.explanation(decision)
+}
+
+// explainer collects the rules that match an item during a lookup.
+type explainer struct {
+	matches []Match
+}
+
+func (x *explainer) add(dl *Denylist, stage MatchStage, hashFn uint64, entries Entries) {
+	for _, e := range entries {
+		status := StatusBlocked
+		if e.AllowRule {
+			status = StatusAllowed
+		}
+		x.matches = append(x.matches, Match{
+			Filename:     dl.Filename,
+			Stage:        stage,
+			HashFunction: hashFn,
+			Status:       status,
+			Entry:        e,
+		})
+	}
+}
+
+func (x *explainer) explanation(decision StatusResponse) Explanation {
+	exp := Explanation{
+		Decision: decision,
+		Matches:  x.matches,
+	}
+	switch decision.Status {
+	case StatusNotFound:
+		exp.Reason = "no denylist has rules for it"
+	case StatusErrored:
+		exp.Reason = fmt.Sprintf("lookup failed: %s", decision.Error)
+	default:
+		exp.Reason = fmt.Sprintf("%s by %s:%d (%s)", decision.Status, decision.Filename, decision.Entry.Line, decision.Entry.RawValue)
+		for _, m := range x.matches {
+			if m.Filename == decision.Filename && m.Entry.Line == decision.Entry.Line {
+				exp.Reason = m.String()
+				break
+			}
+		}
+		switch n := x.otherRules(decision); {
+		case n == 1:
+			exp.Reason += "; 1 other rule matches"
+		case n > 1:
+			exp.Reason += fmt.Sprintf("; %d other rules match", n)
+		}
+	}
+	return exp
+}
+
+// otherRules returns the number of distinct rules that match, other than the
+// one that makes the decision.
+func (x *explainer) otherRules(decision StatusResponse) int {
+	type rule struct {
+		filename string
+		line     uint64
+	}
+	seen := make(map[rule]struct{})
+	for _, m := range x.matches {
+		if m.Filename == decision.Filename && m.Entry.Line == decision.Entry.Line {
+			continue
+		}
+		seen[rule{m.Filename, m.Entry.Line}] = struct{}{}
+	}
+	return len(seen)
+}
+
+// explainIndex records the rules stored under a key in the given index, both
+// in memory and in the snapshot, that match the path.
+func (dl *Denylist) explainIndex(idx *denylistIndexes, x *explainer, stage MatchStage, kind indexKind, mhCode uint64, key []byte, p string) {
+	var matches Entries
+	if idx.snapshot != nil {
+		matches = dl.snapshotEntries(idx.snapshot, kind, mhCode, string(key)).appendMatches(matches, p, dl.skip)
+	}
+	if db := idx.blocksDB(kind, mhCode); db != nil {
+		entries, _ := db.Load(string(key))
+		matches = entries.appendMatches(matches, p, dl.skip)
+	}
+	x.add(dl, stage, mhCode, matches)
+}
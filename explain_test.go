@@ -0,0 +1,112 @@
+package nopfs
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestBlockerExplain(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	// sha256(bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e/)
+	c := cid.MustParse("bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e")
+	legacyDoubleHash := "d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7"
+	doubleHash, err := multihash.Sum([]byte(c.Hash().B58String()), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.deny")
+	writeTestDenylist(t, a, "/ipfs/"+c.String()+"\n//"+doubleHash.B58String()+"\n/**/*.exe\n/ipfs/"+testCid2.String()+"/a/*\n")
+	b := filepath.Join(dir, "b.deny")
+	writeTestDenylist(t, b, "//"+legacyDoubleHash+"\n")
+	allow := filepath.Join(dir, "allow.deny")
+	writeTestDenylist(t, allow, "hints:\n  priority: 10\n---\n+/ipfs/"+c.String()+"\n")
+
+	blocker, err := NewBlocker([]string{a, b, allow}, WithFollow(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	exp := blocker.ExplainCid(c)
+	if exp.Decision.Status != StatusAllowed || exp.Decision.Filename != allow {
+		t.Errorf("expected the allow rule to decide: %s", exp.Decision)
+	}
+	expected := []struct {
+		filename string
+		stage    MatchStage
+		status   Status
+	}{
+		{allow, MatchDirect, StatusAllowed},
+		{a, MatchDirect, StatusBlocked},
+		{a, MatchDoubleHash, StatusBlocked},
+		{b, MatchLegacyDoubleHash, StatusBlocked},
+	}
+	if len(exp.Matches) != len(expected) {
+		t.Fatalf("expected %d matches, got %v", len(expected), exp.Matches)
+	}
+	for i, m := range exp.Matches {
+		if m.Filename != expected[i].filename || m.Stage != expected[i].stage || m.Status != expected[i].status {
+			t.Errorf("unexpected match %d: %s", i, m)
+		}
+		if m.Stage != MatchDirect && m.HashFunction != multihash.SHA2_256 {
+			t.Errorf("double-hash matches should report their function: %s", m)
+		}
+	}
+	if !strings.Contains(exp.Reason, "allowed by "+allow) || !strings.HasSuffix(exp.Reason, "; 3 other rules match") {
+		t.Errorf("unexpected reason: %s", exp.Reason)
+	}
+
+	// Subpath rules are checked first.
+	p, err := path.NewPath("/ipfs/" + testCid2.String() + "/a/b.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = blocker.ExplainPath(p)
+	if exp.Decision.Status != StatusBlocked || exp.Decision.Entry.Line != 3 {
+		t.Errorf("expected the subpath rule to decide: %s", exp.Decision)
+	}
+	if len(exp.Matches) != 2 || exp.Matches[0].Stage != MatchSubpath || exp.Matches[1].Stage != MatchDirect {
+		t.Errorf("expected a subpath and a direct match, got %v", exp.Matches)
+	}
+	if resp := blocker.IsPathBlocked(p); resp.Status != exp.Decision.Status || resp.Entry.Line != exp.Decision.Entry.Line {
+		t.Errorf("decision should match IsPathBlocked: %s vs. %s", exp.Decision, resp)
+	}
+
+	exp = blocker.ExplainCid(testCid3)
+	if exp.Decision.Status != StatusNotFound || len(exp.Matches) != 0 {
+		t.Errorf("%s should have no matches: %v", testCid3, exp.Matches)
+	}
+}
+
+func TestExplanationReason(t *testing.T) {
+	decider := Entry{Line: 2, RawValue: "/ipfs/" + testCid1.String()}
+	other := Entry{Line: 5, RawValue: "/ipfs/" + testCid1.String() + "/*"}
+	x := &explainer{matches: []Match{
+		{Filename: "a.deny", Stage: MatchDirect, Status: StatusBlocked, Entry: decider},
+		{Filename: "a.deny", Stage: MatchDoubleHash, Status: StatusBlocked, Entry: decider},
+		{Filename: "a.deny", Stage: MatchDirect, Status: StatusBlocked, Entry: other},
+		{Filename: "a.deny", Stage: MatchLegacyDoubleHash, Status: StatusBlocked, Entry: other},
+	}}
+
+	// The deciding rule is not counted again, and other rules are
+	// counted once.
+	exp := x.explanation(StatusResponse{Status: StatusBlocked, Filename: "a.deny", Entry: decider})
+	if !strings.HasSuffix(exp.Reason, "; 1 other rule matches") {
+		t.Errorf("unexpected reason: %s", exp.Reason)
+	}
+
+	x.matches = x.matches[:2]
+	exp = x.explanation(StatusResponse{Status: StatusBlocked, Filename: "a.deny", Entry: decider})
+	if strings.Contains(exp.Reason, "other rule") {
+		t.Errorf("unexpected reason: %s", exp.Reason)
+	}
+}
@@ -40,7 +40,7 @@ func (nbs *BlockService) Close() error {
 func (nbs *BlockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	if err := nbs.blocker.IsCidBlocked(c).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return nil, err
+		return nil, blockedError(err)
 	}
 	return nbs.bs.GetBlock(ctx, c)
 }
@@ -48,12 +48,12 @@ func (nbs *BlockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block,
 // GetsBlocks reads several blocks. Blocked CIDs are filtered out of ks.
 func (nbs *BlockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Block {
 	var filtered []cid.Cid
-	for _, c := range ks {
-		if err := nbs.blocker.IsCidBlocked(c).ToError(); err != nil {
+	for i, resp := range nbs.blocker.AreCidsBlocked(ks) {
+		if err := resp.ToError(); err != nil {
 			logger.Warn(err.Response)
 			logger.Warnf("GetBlocks dropped blocked block: %s", err)
 		} else {
-			filtered = append(filtered, c)
+			filtered = append(filtered, ks[i])
 		}
 	}
 	return nbs.bs.GetBlocks(ctx, filtered)
@@ -73,20 +73,24 @@ func (nbs *BlockService) Exchange() exchange.Interface {
 func (nbs *BlockService) AddBlock(ctx context.Context, o blocks.Block) error {
 	if err := nbs.blocker.IsCidBlocked(o.Cid()).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return err
+		return blockedError(err)
 	}
 	return nbs.bs.AddBlock(ctx, o)
 }
 
 // AddBlocks adds multiple blocks. Blocks with blocked CIDs are dropped.
 func (nbs *BlockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
+	cids := make([]cid.Cid, len(bs))
+	for i, o := range bs {
+		cids[i] = o.Cid()
+	}
 	var filtered []blocks.Block
-	for _, o := range bs {
-		if err := nbs.blocker.IsCidBlocked(o.Cid()).ToError(); err != nil {
+	for i, resp := range nbs.blocker.AreCidsBlocked(cids) {
+		if err := resp.ToError(); err != nil {
 			logger.Warn(err.Response)
 			logger.Warnf("AddBlocks dropped blocked block: %s", err)
 		} else {
-			filtered = append(filtered, o)
+			filtered = append(filtered, bs[i])
 		}
 	}
 	return nbs.bs.AddBlocks(ctx, filtered)
@@ -3,7 +3,21 @@
 package ipfs
 
 import (
+	"github.com/ipfs-shipyard/nopfs"
+	"github.com/ipfs/boxo/gateway"
 	logging "github.com/ipfs/go-log/v2"
 )
 
 var logger = logging.Logger("nopfs-blocks")
+
+// blockedError wraps the error for a blocked item so that gateways respond
+// with its HTTP status (see nopfs.StatusResponse.HTTPStatus). The
+// *nopfs.StatusError can still be extracted with errors.As.
+//
+// The gateway only takes the status from its own ErrorStatusCode type
+// (otherwise blocked items are always 410), hence the boxo/gateway import.
+// The indirect requirements it adds to go.mod are those of boxo itself, at
+// the versions boxo already requires, and kubo links them anyway.
+func blockedError(err *nopfs.StatusError) error {
+	return gateway.NewErrorStatusCode(err, err.HTTPStatus())
+}
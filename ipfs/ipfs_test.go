@@ -0,0 +1,113 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs-shipyard/nopfs"
+	"github.com/ipfs/boxo/gateway"
+	"github.com/ipfs/boxo/namesys"
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/boxo/path/resolver"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// nopResolver resolves every path to nothing.
+type nopResolver struct {
+	resolver.Resolver
+}
+
+func (nopResolver) ResolveToLastNode(ctx context.Context, fpath path.ImmutablePath) (cid.Cid, []string, error) {
+	return fpath.RootCid(), nil, nil
+}
+
+func (nopResolver) ResolvePath(ctx context.Context, fpath path.ImmutablePath) (ipld.Node, ipld.Link, error) {
+	return nil, nil, nil
+}
+
+func (nopResolver) ResolvePathComponents(ctx context.Context, fpath path.ImmutablePath) ([]ipld.Node, error) {
+	return nil, nil
+}
+
+// nopNameSystem resolves every name to itself.
+type nopNameSystem struct {
+	namesys.NameSystem
+}
+
+func (nopNameSystem) Resolve(ctx context.Context, p path.Path, options ...namesys.ResolveOption) (namesys.Result, error) {
+	return namesys.Result{Path: p}, nil
+}
+
+func TestBlockedHTTPStatus(t *testing.T) {
+	blockedCid := cid.MustParse("bafybeihvvulpp4evxj7x7armbqcyg6uezzuig6jp3lktpbovlqfkuqeuoq")
+	fname := filepath.Join(t.TempDir(), "test.deny")
+	err := os.WriteFile(fname, []byte("/ipfs/"+blockedCid.String()+" gateway_status=451\n/ipns/example.com\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker, err := nopfs.NewBlocker([]string{fname}, nopfs.WithFollow(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+
+	ctx := context.Background()
+	res := WrapResolver(nopResolver{}, blocker)
+	ns := WrapNameSystem(nopNameSystem{}, blocker)
+	ipfsPath, err := path.NewPath("/ipfs/" + blockedCid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	immPath, err := path.NewImmutablePath(ipfsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipnsPath, err := path.NewPath("/ipns/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		resolve  func() error
+		expected int
+	}{
+		{"ResolveToLastNode", func() error {
+			_, _, err := res.ResolveToLastNode(ctx, immPath)
+			return err
+		}, 451},
+		{"ResolvePath", func() error {
+			_, _, err := res.ResolvePath(ctx, immPath)
+			return err
+		}, 451},
+		{"ResolvePathComponents", func() error {
+			_, err := res.ResolvePathComponents(ctx, immPath)
+			return err
+		}, 451},
+		{"NameSystem.Resolve", func() error {
+			_, err := ns.Resolve(ctx, ipnsPath)
+			return err
+		}, nopfs.DefaultBlockedHTTPStatus},
+		{"NameSystem.ResolveAsync", func() error {
+			return (<-ns.ResolveAsync(ctx, ipnsPath)).Err
+		}, nopfs.DefaultBlockedHTTPStatus},
+	} {
+		err := tc.resolve()
+		var gwErr *gateway.ErrorStatusCode
+		if !errors.As(err, &gwErr) {
+			t.Errorf("%s: expected a gateway error: %v", tc.name, err)
+			continue
+		}
+		if gwErr.StatusCode != tc.expected {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expected, gwErr.StatusCode)
+		}
+		var statusErr *nopfs.StatusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("%s: expected a StatusError: %v", tc.name, err)
+		}
+	}
+}
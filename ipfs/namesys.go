@@ -31,7 +31,7 @@ func WrapNameSystem(ns namesys.NameSystem, blocker *nopfs.Blocker) namesys.NameS
 func (ns *NameSystem) Resolve(ctx context.Context, p path.Path, options ...namesys.ResolveOption) (namesys.Result, error) {
 	if err := ns.blocker.IsPathBlocked(p).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return namesys.Result{}, err
+		return namesys.Result{}, blockedError(err)
 	}
 	return ns.ns.Resolve(ctx, p, options...)
 }
@@ -44,7 +44,7 @@ func (ns *NameSystem) ResolveAsync(ctx context.Context, p path.Path, options ...
 		ch := make(chan namesys.AsyncResult, 1)
 		ch <- namesys.AsyncResult{
 			Path: status.Path,
-			Err:  err,
+			Err:  blockedError(err),
 		}
 		close(ch)
 		return ch
@@ -32,7 +32,7 @@ func WrapResolver(res resolver.Resolver, blocker *nopfs.Blocker) resolver.Resolv
 func (res *Resolver) ResolveToLastNode(ctx context.Context, fpath path.ImmutablePath) (cid.Cid, []string, error) {
 	if err := res.blocker.IsPathBlocked(fpath).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return cid.Undef, nil, err
+		return cid.Undef, nil, blockedError(err)
 	}
 	return res.resolver.ResolveToLastNode(ctx, fpath)
 }
@@ -41,7 +41,7 @@ func (res *Resolver) ResolveToLastNode(ctx context.Context, fpath path.Immutable
 func (res *Resolver) ResolvePath(ctx context.Context, fpath path.ImmutablePath) (ipld.Node, ipld.Link, error) {
 	if err := res.blocker.IsPathBlocked(fpath).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return nil, nil, err
+		return nil, nil, blockedError(err)
 	}
 	return res.resolver.ResolvePath(ctx, fpath)
 }
@@ -50,7 +50,7 @@ func (res *Resolver) ResolvePath(ctx context.Context, fpath path.ImmutablePath)
 func (res *Resolver) ResolvePathComponents(ctx context.Context, fpath path.ImmutablePath) ([]ipld.Node, error) {
 	if err := res.blocker.IsPathBlocked(fpath).ToError(); err != nil {
 		logger.Warn(err.Response)
-		return nil, err
+		return nil, blockedError(err)
 	}
 	return res.resolver.ResolvePathComponents(ctx, fpath)
 }
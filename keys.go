@@ -0,0 +1,375 @@
+package nopfs
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// The indexes of CID-based rules (IPFS rules, IPNS rules for keys and
+// double-hash rules) are keyed by raw multihash bytes. The helpers below
+// build those keys, and the strings that are double-hashed, into buffers
+// provided by the caller, so that lookups do not need to allocate.
+
+const b58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var b58Indexes = func() [256]byte {
+	var idx [256]byte
+	for i := range idx {
+		idx[i] = 0xff
+	}
+	for i := 0; i < len(b58Alphabet); i++ {
+		idx[b58Alphabet[i]] = byte(i)
+	}
+	return idx
+}()
+
+var b32Encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+var errInvalidBase58 = errors.New("invalid base58 string")
+
+// keyBufferSize is enough for the keys and double-hashed strings of most
+// lookups. Longer ones are allocated.
+const keyBufferSize = 256
+
+// b58Key is a key that is printed base58-encoded (only when it needs to be
+// printed, i.e. in debug logs).
+type b58Key string
+
+func (k b58Key) String() string {
+	return string(appendB58(nil, []byte(k)))
+}
+
+// cidMultihash appends the multihash of a CID to dst.
+func cidMultihash(dst []byte, c cid.Cid) []byte {
+	s := c.KeyString()
+	if c.Version() == 0 {
+		return append(dst, s...)
+	}
+	// Skip the version and codec varints.
+	i := 0
+	for n := 0; n < 2 && i < len(s); i++ {
+		if s[i]&0x80 == 0 {
+			n++
+		}
+	}
+	return append(dst, s[i:]...)
+}
+
+// appendCidV1B32 appends the base32 string of the CIDv1 with the given codec
+// and multihash to dst.
+func appendCidV1B32(dst []byte, codec uint64, mh []byte) []byte {
+	var buf [keyBufferSize]byte
+	n := binary.PutUvarint(buf[:], 1)
+	n += binary.PutUvarint(buf[n:], codec)
+	raw := append(buf[:n], mh...)
+
+	dst = append(dst, 'b')
+	start := len(dst)
+	size := b32Encoding.EncodedLen(len(raw))
+	for i := 0; i < size; i++ {
+		dst = append(dst, 0)
+	}
+	b32Encoding.Encode(dst[start:], raw)
+	return dst
+}
+
+// Base58 is converted in chunks of 5 digits (58^5 < 2^32) to and from
+// chunks of 4 bytes, rather than digit by digit.
+const (
+	b58ChunkDigits = 5
+	b58ChunkBase   = 58 * 58 * 58 * 58 * 58
+)
+
+// appendB58 appends the base58btc encoding of src to dst.
+func appendB58(dst, src []byte) []byte {
+	zeros := 0
+	for zeros < len(src) && src[zeros] == 0 {
+		zeros++
+	}
+	for i := 0; i < zeros; i++ {
+		dst = append(dst, '1')
+	}
+	src = src[zeros:]
+
+	// Little-endian base 58^5 limbs. log(256) / log(58^5) ~ 0.2731
+	var buf [keyBufferSize / 4]uint32
+	var limbs []uint32
+	if size := len(src)*275/1000 + 1; size <= len(buf) {
+		limbs = buf[:size]
+	} else {
+		limbs = make([]uint32, size)
+	}
+
+	used := 0
+	for len(src) > 0 {
+		// Take the remainder first so that the following chunks
+		// have 4 bytes.
+		n := len(src) % 4
+		if n == 0 {
+			n = 4
+		}
+		var carry uint64
+		for _, b := range src[:n] {
+			carry = carry<<8 | uint64(b)
+		}
+		src = src[n:]
+
+		for j := 0; j < used; j++ {
+			v := uint64(limbs[j])<<(8*n) | carry
+			limbs[j] = uint32(v % b58ChunkBase)
+			carry = v / b58ChunkBase
+		}
+		for ; carry > 0; used++ {
+			limbs[used] = uint32(carry % b58ChunkBase)
+			carry /= b58ChunkBase
+		}
+	}
+
+	for i := used - 1; i >= 0; i-- {
+		var digits [b58ChunkDigits]byte
+		limb := limbs[i]
+		for j := b58ChunkDigits - 1; j >= 0; j-- {
+			digits[j] = b58Alphabet[limb%58]
+			limb /= 58
+		}
+		if i == used-1 {
+			// No leading zeros for the most significant limb.
+			k := 0
+			for k < b58ChunkDigits-1 && digits[k] == '1' {
+				k++
+			}
+			dst = append(dst, digits[k:]...)
+			continue
+		}
+		dst = append(dst, digits[:]...)
+	}
+	return dst
+}
+
+// decodeB58 appends the bytes encoded in a base58btc string to dst.
+func decodeB58(dst []byte, s string) ([]byte, error) {
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	for i := 0; i < zeros; i++ {
+		dst = append(dst, 0)
+	}
+	s = s[zeros:]
+
+	// Little-endian base 2^32 limbs. log(58) / log(2^32) ~ 0.1831
+	var buf [keyBufferSize / 4]uint32
+	var limbs []uint32
+	if size := len(s)*184/1000 + 1; size <= len(buf) {
+		limbs = buf[:size]
+	} else {
+		limbs = make([]uint32, size)
+	}
+
+	used := 0
+	for len(s) > 0 {
+		// Take the remainder first so that the following chunks
+		// have 5 digits.
+		n := len(s) % b58ChunkDigits
+		if n == 0 {
+			n = b58ChunkDigits
+		}
+		var carry uint64
+		mult := uint64(1)
+		for i := 0; i < n; i++ {
+			d := b58Indexes[s[i]]
+			if d == 0xff {
+				return dst, errInvalidBase58
+			}
+			carry = carry*58 + uint64(d)
+			mult *= 58
+		}
+		s = s[n:]
+
+		for j := 0; j < used; j++ {
+			v := uint64(limbs[j])*mult + carry
+			limbs[j] = uint32(v)
+			carry = v >> 32
+		}
+		for ; carry > 0; used++ {
+			limbs[used] = uint32(carry)
+			carry >>= 32
+		}
+	}
+
+	for i := used - 1; i >= 0; i-- {
+		limb := limbs[i]
+		bytes := [4]byte{byte(limb >> 24), byte(limb >> 16), byte(limb >> 8), byte(limb)}
+		if i == used-1 {
+			// No leading zeros for the most significant limb.
+			k := 0
+			for k < 3 && bytes[k] == 0 {
+				k++
+			}
+			dst = append(dst, bytes[k:]...)
+			continue
+		}
+		dst = append(dst, bytes[:]...)
+	}
+	return dst, nil
+}
+
+// appendDoubleHash appends to dst the multihash of data using the hashing
+// function with the given code. Only sha2-256 avoids allocating.
+func appendDoubleHash(dst, data []byte, code uint64) ([]byte, error) {
+	if code == multihash.SHA2_256 {
+		sum := sha256.Sum256(data)
+		dst = append(dst, multihash.SHA2_256, sha256.Size)
+		return append(dst, sum[:]...), nil
+	}
+	// Copied so that data, usually in the stack of the caller, does
+	// not escape.
+	mh, err := multihash.Sum(append([]byte(nil), data...), code, -1)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, mh...), nil
+}
+
+// hashInput identifies the strings that are double-hashed in a lookup.
+type hashInput int
+
+const (
+	// inputLegacy is "<cidv1b32>/<path>" (or "<name>/<path>" for IPNS
+	// names), hashed with sha2-256 for legacy double-hash rules.
+	inputLegacy hashInput = iota
+	// inputModern is "<b58mh>/<path>" (or "/ipns/<name>/<path>"),
+	// hashed with every function used by double-hash rules.
+	inputModern
+)
+
+// lookupHashesSize is the number of double-hashes that lookupHashes keeps.
+// More are computed every time.
+const lookupHashesSize = 8
+
+// lookupHashes holds the strings that are double-hashed during a lookup and
+// memoizes their double-hashes. A Blocker shares one among its denylists
+// (and its bloom filter), so that each hash is computed once per lookup
+// rather than once per denylist. It must only be used for lookups of a
+// single item.
+//
+// It is meant to live in the stack, so it stores lengths rather than
+// slices of its own buffers, which would make it escape. Longer strings
+// and hashes are copied to the heap.
+//
+// When explain is set, lookups go through all their stages, recording
+// every matching rule, rather than stopping at the first match (see
+// Blocker.ExplainCid).
+type lookupHashes struct {
+	explain *explainer
+
+	inputSet  [2]bool
+	inputLen  [2]int
+	inputBuf  [2][keyBufferSize]byte
+	inputLong [2][]byte
+	n         int
+	hashes    [lookupHashesSize]memoHash
+}
+
+type memoHash struct {
+	input hashInput
+	code  uint64
+	n     int
+	long  []byte
+	err   error
+	buf   [keyBufferSize / 2]byte
+}
+
+// reset prepares the lookupHashes for the lookup of another item, reusing
+// its buffers.
+func (lh *lookupHashes) reset() {
+	lh.inputSet = [2]bool{}
+	lh.inputLong = [2][]byte{}
+	for i := 0; i < lh.n; i++ {
+		lh.hashes[i].long = nil
+	}
+	lh.n = 0
+}
+
+// hasInput returns whether an input string has been set.
+func (lh *lookupHashes) hasInput(in hashInput) bool {
+	return lh.inputSet[in]
+}
+
+// inputBuffer returns an empty buffer to build an input string in, to be
+// passed to setInput then.
+func (lh *lookupHashes) inputBuffer(in hashInput) []byte {
+	return lh.inputBuf[in][:0]
+}
+
+func (lh *lookupHashes) setInput(in hashInput, data []byte) {
+	lh.inputSet[in] = true
+	if len(data) <= keyBufferSize {
+		lh.inputLen[in] = copy(lh.inputBuf[in][:], data)
+		return
+	}
+	lh.inputLong[in] = append([]byte(nil), data...)
+}
+
+func (lh *lookupHashes) input(in hashInput) []byte {
+	if lh.inputLong[in] != nil {
+		return lh.inputLong[in]
+	}
+	return lh.inputBuf[in][:lh.inputLen[in]]
+}
+
+// doubleHash returns the multihash of an input string, which must have been
+// set, using the hashing function with the given code.
+func (lh *lookupHashes) doubleHash(in hashInput, code uint64) ([]byte, error) {
+	for i := 0; i < lh.n; i++ {
+		if m := &lh.hashes[i]; m.input == in && m.code == code {
+			return m.hash(), m.err
+		}
+	}
+	if lh.n == len(lh.hashes) {
+		return appendDoubleHash(nil, lh.input(in), code)
+	}
+	m := &lh.hashes[lh.n]
+	lh.n++
+	m.input = in
+	m.code = code
+	hash, err := appendDoubleHash(m.buf[:0], lh.input(in), code)
+	if len(hash) <= len(m.buf) {
+		m.n = len(hash)
+	} else {
+		m.long = append([]byte(nil), hash...)
+	}
+	m.err = err
+	return m.hash(), m.err
+}
+
+func (m *memoHash) hash() []byte {
+	if m.long != nil {
+		return m.long
+	}
+	return m.buf[:m.n]
+}
+
+// setCidLegacyInput sets the legacy input for a CID lookup ("<cidv1b32>/"),
+// unless set already.
+func setCidLegacyInput(lh *lookupHashes, c cid.Cid, mh []byte) {
+	if lh.hasInput(inputLegacy) {
+		return
+	}
+	b32 := appendCidV1B32(lh.inputBuffer(inputLegacy), c.Type(), mh)
+	lh.setInput(inputLegacy, append(b32, '/')) // yes, needed
+}
+
+// setCidModernInput sets the input for a CID lookup (the b58-encoded
+// multihash), unless set already.
+func setCidModernInput(lh *lookupHashes, mh []byte) {
+	if lh.hasInput(inputModern) {
+		return
+	}
+	lh.setInput(inputModern, appendB58(lh.inputBuffer(inputModern), mh))
+}
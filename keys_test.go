@@ -0,0 +1,114 @@
+package nopfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestB58(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		src := make([]byte, rng.Intn(300))
+		rng.Read(src)
+		// Leading zeros are encoded separately.
+		for j := 0; j < len(src) && rng.Intn(4) == 0; j++ {
+			src[j] = 0
+		}
+
+		mb, err := multibase.Encode(multibase.Base58BTC, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := mb[1:]
+		encoded := appendB58([]byte("prefix"), src)
+		if string(encoded) != "prefix"+expected {
+			t.Fatalf("appendB58(%x) = %s, expected %s", src, encoded[6:], expected)
+		}
+
+		decoded, err := decodeB58([]byte("prefix"), expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, append([]byte("prefix"), src...)) {
+			t.Fatalf("decodeB58(%s) = %x, expected %x", expected, decoded[6:], src)
+		}
+	}
+
+	if _, err := decodeB58(nil, "Qm0"); err == nil {
+		t.Error("expected an error for an invalid base58 string")
+	}
+}
+
+func TestCidKeys(t *testing.T) {
+	for _, c := range []cid.Cid{
+		testCid1,
+		testCid2,
+		cid.NewCidV1(cid.Raw, bloomTestKey(1)),
+		cid.NewCidV1(cid.DagJSON, bloomTestKey(2)),
+		cid.MustParse("bafkqaaa"),
+	} {
+		mh := cidMultihash(nil, c)
+		if !bytes.Equal(mh, c.Hash()) {
+			t.Errorf("%s: wrong multihash: %x", c, mh)
+		}
+
+		expected, err := cid.NewCidV1(c.Type(), c.Hash()).StringOfBase(multibase.Base32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b32 := appendCidV1B32(nil, c.Type(), mh); string(b32) != expected {
+			t.Errorf("%s: wrong base32 CIDv1: %s", c, b32)
+		}
+
+		for _, code := range []uint64{multihash.SHA2_256, multihash.BLAKE3} {
+			expected, err := multihash.Sum(mh, code, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dh, err := appendDoubleHash(nil, mh, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dh, expected) {
+				t.Errorf("%s: wrong double-hash with %d: %x", c, code, dh)
+			}
+		}
+	}
+}
+
+func TestLookupHashes(t *testing.T) {
+	var lh lookupHashes
+	long := bytes.Repeat([]byte("a"), keyBufferSize+1)
+	lh.setInput(inputLegacy, append(lh.inputBuffer(inputLegacy), "short"...))
+	lh.setInput(inputModern, long)
+
+	codes := []uint64{multihash.SHA2_256, multihash.BLAKE3, multihash.SHA2_512, multihash.SHA3_256, multihash.SHA3_512}
+	for i := 0; i < 2; i++ { // the second time, hashes are memoized
+		for _, in := range []hashInput{inputLegacy, inputModern} {
+			for _, code := range codes {
+				expected, err := multihash.Sum(lh.input(in), code, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dh, err := lh.doubleHash(in, code)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(dh, expected) {
+					t.Errorf("%d, %d: wrong double-hash: %x", in, code, dh)
+				}
+			}
+		}
+	}
+	if !bytes.Equal(lh.input(inputModern), long) {
+		t.Error("long input not kept")
+	}
+	if lh.n != lookupHashesSize {
+		t.Errorf("expected %d memoized hashes, got %d", lookupHashesSize, lh.n)
+	}
+}
@@ -0,0 +1,147 @@
+package nopfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// parseBatchLines is the number of lines handed at once to the goroutines
+// that parse denylists in parallel.
+const parseBatchLines = 4096
+
+// parseBatch is a chunk of consecutive lines of a denylist and the results
+// of parsing them.
+type parseBatch struct {
+	first   uint64 // number of the first line
+	lines   []string
+	results []parsedLine
+	done    chan struct{} // closed when parsed
+}
+
+type parsedLine struct {
+	entry   Entry
+	indexed []indexedEntry
+	err     error
+}
+
+func (b *parseBatch) parse(dl *Denylist) {
+	b.results = make([]parsedLine, len(b.lines))
+	for i, line := range b.lines {
+		r := &b.results[i]
+		r.entry, r.indexed, r.err = dl.parseEntry(line, b.first+uint64(i), dl.Header.Hints)
+	}
+	b.lines = nil
+	close(b.done)
+}
+
+// loadLines parses the lines available in the lineReader, up to EOF, using
+// several goroutines (see WithParseWorkers). Lines are read and split in
+// batches sequentially, batches are parsed in parallel (parseEntry does not
+// modify the Denylist) and the results are stored in the order of the
+// lines, so that the last rule for an item still wins.
+//
+// Like followLines, it closes the Denylist on error. Errors parsing rules
+// are only fatal when strict is set (see storeBatch). Any partial line at
+// EOF is left in the lineReader.
+func (dl *Denylist) loadLines(lr *lineReader, strict bool) error {
+	workers := dl.cfg.parseWorkers
+	if workers <= 1 {
+		return nil
+	}
+
+	work := make(chan *parseBatch)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for b := range work {
+				b.parse(dl)
+			}
+		}()
+	}
+
+	// A single goroutine stores the results, as they are parsed, in
+	// order.
+	parsed := make(chan *parseBatch, 2*workers)
+	var storeErr error
+	stop := make(chan struct{}) // closed on storeErr
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		for b := range parsed {
+			<-b.done
+			if storeErr != nil {
+				continue
+			}
+			if storeErr = dl.storeBatch(b, strict); storeErr != nil {
+				close(stop)
+			}
+		}
+	}()
+
+	var err error
+read:
+	for err == nil {
+		b := &parseBatch{
+			first: lr.lineNumber + 1,
+			lines: make([]string, 0, parseBatchLines),
+			done:  make(chan struct{}),
+		}
+		for len(b.lines) < parseBatchLines {
+			var line string
+			line, err = lr.readLine()
+			if err != nil {
+				break
+			}
+			b.lines = append(b.lines, line)
+		}
+		if len(b.lines) == 0 {
+			break
+		}
+
+		select {
+		case parsed <- b:
+			work <- b
+		case <-stop:
+			break read
+		}
+	}
+	close(work)
+	close(parsed)
+	<-stored
+
+	switch {
+	case storeErr != nil:
+		dl.Close()
+		return storeErr
+	case err == errLineTooLong:
+		err = fmt.Errorf("line too long. %s:%d", dl.Filename, lr.lineNumber+1)
+		dl.cfg.logger.Error(err)
+		dl.Close()
+		return err
+	case err != nil && err != io.EOF:
+		dl.cfg.logger.Error(err)
+		dl.Close()
+		return err
+	}
+	return nil
+}
+
+// storeBatch adds the rules in a parsed batch to the indexes. Errors are
+// logged, or returned when strict.
+func (dl *Denylist) storeBatch(b *parseBatch, strict bool) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for _, r := range b.results {
+		err := r.err
+		if err == nil && len(r.indexed) > 0 {
+			err = dl.addEntry(r.entry, r.indexed)
+		}
+		if err != nil {
+			if strict {
+				return err
+			}
+			dl.cfg.logger.Error(err)
+			dl.cfg.events.emit(Event{Type: EventParseError, Filename: dl.Filename, Err: err})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package nopfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+)
+
+// newLookupBenchDenylist returns a denylist with a mix of rules of every
+// kind, like the ones found in the wild.
+func newLookupBenchDenylist(tb testing.TB) *Denylist {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		mh := bloomTestKey(i)
+		c := cid.NewCidV1(cid.DagProtobuf, mh)
+		legacy := sha256.Sum256([]byte(c.String() + "/"))
+		dh, err := multihash.Sum([]byte(multihash.Multihash(mh).B58String()), multihash.SHA2_256, -1)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		fmt.Fprintf(&sb, "/ipfs/%s\n", c)
+		fmt.Fprintf(&sb, "/ipfs/%s/path%d\n", cid.NewCidV0(mh), i)
+		fmt.Fprintf(&sb, "//%s\n", hex.EncodeToString(legacy[:]))
+		fmt.Fprintf(&sb, "//%s\n", dh.B58String())
+		fmt.Fprintf(&sb, "/ipns/name%d.example\n", i)
+		fmt.Fprintf(&sb, "path%d/*\n", i)
+	}
+	dl, err := NewDenylistReader(testReader{strings.NewReader(sb.String())})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dl
+}
+
+// lookupBenchCases are lookups for items that are not blocked, which is the
+// common case, and therefore need to check every index.
+func lookupBenchCases(tb testing.TB) []struct {
+	name   string
+	lookup func(dl *Denylist) StatusResponse
+} {
+	mh := bloomTestKey(-1)
+	v0 := cid.NewCidV0(mh)
+	v1 := cid.NewCidV1(cid.DagProtobuf, mh)
+	v0Path, err := path.NewPath("/ipfs/" + v0.String() + "/a/b")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	v1Path, err := path.NewPath("/ipfs/" + v1.String() + "/a/b")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return []struct {
+		name   string
+		lookup func(dl *Denylist) StatusResponse
+	}{
+		{"IsCidBlocked/v0", func(dl *Denylist) StatusResponse { return dl.IsCidBlocked(v0) }},
+		{"IsCidBlocked/v1", func(dl *Denylist) StatusResponse { return dl.IsCidBlocked(v1) }},
+		{"IsPathBlocked/v0", func(dl *Denylist) StatusResponse { return dl.IsPathBlocked(v0Path) }},
+		{"IsPathBlocked/v1", func(dl *Denylist) StatusResponse { return dl.IsPathBlocked(v1Path) }},
+	}
+}
+
+func BenchmarkLookups(b *testing.B) {
+	dl := newLookupBenchDenylist(b)
+	for _, tc := range lookupBenchCases(b) {
+		tc := tc
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if resp := tc.lookup(dl); resp.Status != StatusNotFound {
+					b.Fatal(resp)
+				}
+			}
+		})
+	}
+}
+
+// TestLookupAllocs checks that lookups that only involve CIDv0 or sha2-256
+// keys do not allocate.
+func TestLookupAllocs(t *testing.T) {
+	dl := newLookupBenchDenylist(t)
+	for _, tc := range lookupBenchCases(t) {
+		if strings.HasSuffix(tc.name, "IsPathBlocked/v1") {
+			// Parsing CIDv1 strings allocates.
+			continue
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			tc.lookup(dl)
+		})
+		if allocs > 0 {
+			t.Errorf("%s: expected no allocations, got %f", tc.name, allocs)
+		}
+	}
+}
+
+// BenchmarkBlockerLookups looks up items that are not blocked in a Blocker
+// with several denylists. Double-hashes are computed once for all of them.
+func BenchmarkBlockerLookups(b *testing.B) {
+	blocker := &Blocker{cfg: newConfig(nil)}
+	for i := 0; i < 5; i++ {
+		dl := newLookupBenchDenylist(b)
+		dl.Filename = fmt.Sprintf("list%d", i)
+		blocker.addDenylist(dl)
+	}
+	mh := bloomTestKey(-1)
+	c := cid.NewCidV1(cid.DagProtobuf, mh)
+	p, err := path.NewPath("/ipfs/" + cid.NewCidV0(mh).String() + "/a/b")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("IsCidBlocked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if resp := blocker.IsCidBlocked(c); resp.Status != StatusNotFound {
+				b.Fatal(resp)
+			}
+		}
+	})
+	b.Run("IsPathBlocked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if resp := blocker.IsPathBlocked(p); resp.Status != StatusNotFound {
+				b.Fatal(resp)
+			}
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package nopfs
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+)
+
+// lookupMap is a hash map from strings to *V that lookups read without
+// taking locks while it is modified. It supports a single writer: store and
+// delete must not be called concurrently with each other.
+//
+// Keys are chained in buckets of nodes that are never modified once
+// published, other than their value, which is replaced atomically. When the
+// map grows, the writer builds a bigger table and publishes it, so readers
+// keep using the table they started with. The values are not copied and
+// must be treated as immutable.
+type lookupMap[V any] struct {
+	table atomic.Value // *lookupTable[V]
+
+	// Only used by the writer.
+	count int // keys with a value
+	dead  int // deleted keys still in the table
+}
+
+type lookupTable[V any] struct {
+	seed    maphash.Seed
+	buckets []atomic.Value // *lookupNode[V]
+}
+
+type lookupNode[V any] struct {
+	hash  uint64
+	key   string
+	next  *lookupNode[V]
+	value atomic.Value // *V, nil when deleted
+}
+
+// lookupMapMinSize is the initial number of buckets of a lookupMap.
+const lookupMapMinSize = 8
+
+func (m *lookupMap[V]) loadTable() *lookupTable[V] {
+	t, _ := m.table.Load().(*lookupTable[V])
+	return t
+}
+
+func (t *lookupTable[V]) bucket(h uint64) *atomic.Value {
+	return &t.buckets[h&uint64(len(t.buckets)-1)]
+}
+
+func (t *lookupTable[V]) head(h uint64) *lookupNode[V] {
+	n, _ := t.bucket(h).Load().(*lookupNode[V])
+	return n
+}
+
+// insert adds a node for a key that is not in the table.
+func (t *lookupTable[V]) insert(h uint64, key string, v *V) {
+	n := &lookupNode[V]{hash: h, key: key, next: t.head(h)}
+	n.value.Store(v)
+	t.bucket(h).Store(n)
+}
+
+func (t *lookupTable[V]) hashString(key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(t.seed)
+	h.WriteString(key)
+	return h.Sum64()
+}
+
+func (t *lookupTable[V]) hashBytes(key []byte) uint64 {
+	var h maphash.Hash
+	h.SetSeed(t.seed)
+	h.Write(key)
+	return h.Sum64()
+}
+
+// node returns the node for key, if any.
+func (t *lookupTable[V]) node(h uint64, key string) *lookupNode[V] {
+	for n := t.head(h); n != nil; n = n.next {
+		if n.hash == h && n.key == key {
+			return n
+		}
+	}
+	return nil
+}
+
+// load returns the value for key, or nil.
+func (m *lookupMap[V]) load(key string) *V {
+	t := m.loadTable()
+	if t == nil {
+		return nil
+	}
+	if n := t.node(t.hashString(key), key); n != nil {
+		v, _ := n.value.Load().(*V)
+		return v
+	}
+	return nil
+}
+
+// loadBytes is load for a key given as bytes, without allocating.
+func (m *lookupMap[V]) loadBytes(key []byte) *V {
+	t := m.loadTable()
+	if t == nil {
+		return nil
+	}
+	h := t.hashBytes(key)
+	for n := t.head(h); n != nil; n = n.next {
+		if n.hash == h && n.key == string(key) {
+			v, _ := n.value.Load().(*V)
+			return v
+		}
+	}
+	return nil
+}
+
+// empty returns true when no keys were ever stored.
+func (m *lookupMap[V]) empty() bool {
+	return m.loadTable() == nil
+}
+
+// store sets the value for key. v must not be nil.
+func (m *lookupMap[V]) store(key string, v *V) {
+	t := m.loadTable()
+	if t == nil {
+		t = m.grow()
+	}
+	h := t.hashString(key)
+	if n := t.node(h, key); n != nil {
+		if old, _ := n.value.Load().(*V); old == nil {
+			m.count++
+			m.dead--
+		}
+		n.value.Store(v)
+		return
+	}
+	if m.count+m.dead >= len(t.buckets) {
+		t = m.grow()
+	}
+	m.count++
+	t.insert(h, key, v)
+}
+
+// delete removes the value for key, if any.
+func (m *lookupMap[V]) delete(key string) {
+	t := m.loadTable()
+	if t == nil {
+		return
+	}
+	n := t.node(t.hashString(key), key)
+	if n == nil {
+		return
+	}
+	if old, _ := n.value.Load().(*V); old != nil {
+		n.value.Store((*V)(nil))
+		m.count--
+		m.dead++
+	}
+}
+
+// grow publishes a new table with room for the keys with a value, leaving
+// the deleted ones out, and returns it. The hashes of the keys do not
+// change, only the buckets they are in.
+func (m *lookupMap[V]) grow() *lookupTable[V] {
+	size := lookupMapMinSize
+	for size < 2*(m.count+1) {
+		size *= 2
+	}
+	t := &lookupTable[V]{buckets: make([]atomic.Value, size)}
+	old := m.loadTable()
+	if old == nil {
+		t.seed = maphash.MakeSeed()
+	} else {
+		t.seed = old.seed
+		for i := range old.buckets {
+			n, _ := old.buckets[i].Load().(*lookupNode[V])
+			for ; n != nil; n = n.next {
+				if v, _ := n.value.Load().(*V); v != nil {
+					t.insert(n.hash, n.key, v)
+				}
+			}
+		}
+	}
+	m.dead = 0
+	m.table.Store(t)
+	return t
+}
+
+// forEach calls fn for every key with a value, in no particular order.
+func (m *lookupMap[V]) forEach(fn func(key string, v *V)) {
+	t := m.loadTable()
+	if t == nil {
+		return
+	}
+	for i := range t.buckets {
+		n, _ := t.buckets[i].Load().(*lookupNode[V])
+		for ; n != nil; n = n.next {
+			if v, _ := n.value.Load().(*V); v != nil {
+				fn(n.key, v)
+			}
+		}
+	}
+}
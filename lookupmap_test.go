@@ -0,0 +1,91 @@
+package nopfs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLookupMap(t *testing.T) {
+	var m lookupMap[int]
+	if m.load("a") != nil || !m.empty() {
+		t.Fatal("expected an empty map")
+	}
+
+	for i := 0; i < 1000; i++ {
+		v := i
+		m.store(fmt.Sprint(i), &v)
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.delete(fmt.Sprint(i))
+	}
+	for i := 0; i < 1000; i++ {
+		v := m.loadBytes([]byte(fmt.Sprint(i)))
+		switch {
+		case i%2 == 0 && v != nil:
+			t.Errorf("%d: expected it to be deleted", i)
+		case i%2 == 1 && (v == nil || *v != i):
+			t.Errorf("%d: expected %d, got %v", i, i, v)
+		}
+	}
+
+	// Deleted keys can be stored again, and are left out when the
+	// table grows.
+	v := -1
+	m.store("0", &v)
+	for i := 1000; i < 2000; i++ {
+		v := i
+		m.store(fmt.Sprint(i), &v)
+	}
+	if got := m.load("0"); got == nil || *got != -1 {
+		t.Errorf("expected -1, got %v", got)
+	}
+	n := 0
+	m.forEach(func(string, *int) { n++ })
+	if n != 1501 || m.count != 1501 {
+		t.Errorf("expected 1501 keys, found %d (count %d)", n, m.count)
+	}
+}
+
+func TestLookupMapConcurrent(t *testing.T) {
+	var m lookupMap[int]
+	const keys = 10000
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Keys are stored in order, so once a key is
+				// found, all the previous ones must be too.
+				found := false
+				for i := keys - 1; i >= 0; i -= 97 {
+					v := m.load(fmt.Sprint(i))
+					switch {
+					case v != nil && *v != i:
+						t.Errorf("%d: got %d", i, *v)
+						return
+					case v == nil && found:
+						t.Errorf("%d: missing after a later key was found", i)
+						return
+					}
+					found = v != nil
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < keys; i++ {
+		v := i
+		m.store(fmt.Sprint(i), &v)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -7,6 +7,8 @@ toolchain go1.23.3
 // Retract test releases that conflict with naming scheme.
 retract [v0.21.0-rc1-test10, v0.21.0-rc1-test999]
 
+replace github.com/ipfs-shipyard/nopfs => ../
+
 require (
 	github.com/ipfs-shipyard/nopfs v0.0.13
 	github.com/ipfs-shipyard/nopfs/ipfs v0.25.0
@@ -178,6 +180,7 @@ require (
 	github.com/whyrusleeping/multiaddr-filter v0.0.0-20160516205228-e903e4adabd7 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
 	github.com/zeebo/blake3 v0.2.4 // indirect
+	go.etcd.io/bbolt v1.3.9 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.56.0 // indirect
 	go.opentelemetry.io/otel v1.31.0 // indirect
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/ipfs-shipyard/nopfs"
 	"github.com/ipfs-shipyard/nopfs/ipfs"
 	logging "github.com/ipfs/go-log/v2"
@@ -19,7 +21,10 @@ var Plugins = []plugin.Plugin{
 
 // fxtestPlugin is used for testing the fx plugin.
 // It merely adds an fx option that logs a debug statement, so we can verify that it works in tests.
-type nopfsPlugin struct{}
+type nopfsPlugin struct {
+	// snapshots enables writing and using denylist snapshots.
+	snapshots bool
+}
 
 var _ plugin.PluginFx = (*nopfsPlugin)(nil)
 
@@ -31,18 +36,42 @@ func (p *nopfsPlugin) Version() string {
 	return "0.0.1"
 }
 
+// Init reads the plugin configuration, set in the Kubo config with:
+//
+//	"Plugins": {
+//	  "Plugins": {
+//	    "nopfs": {
+//	      "Config": {
+//	        "Snapshots": true
+//	      }
+//	    }
+//	  }
+//	}
 func (p *nopfsPlugin) Init(env *plugin.Environment) error {
+	if env == nil || env.Config == nil {
+		return nil
+	}
+	cfg, ok := env.Config.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("nopfs: invalid plugin config: %v", env.Config)
+	}
+	if v, ok := cfg["Snapshots"]; ok {
+		snapshots, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("nopfs: Snapshots must be a boolean: %v", v)
+		}
+		p.snapshots = snapshots
+	}
 	return nil
 }
 
 // MakeBlocker is a factory for the blocker so that it can be provided with Fx.
-func MakeBlocker() (*nopfs.Blocker, error) {
-	files, err := nopfs.GetDenylistFiles()
-	if err != nil {
-		return nil, err
-	}
-
-	return nopfs.NewBlocker(files)
+// The default denylist folders are watched so that denylists can be added
+// and removed without restarting. When enabled in the plugin config,
+// snapshots are written next to the denylists to speed up loading large
+// ones on start.
+func (p *nopfsPlugin) MakeBlocker() (*nopfs.Blocker, error) {
+	return nopfs.NewDirBlocker(nopfs.GetDenylistDirs(), nopfs.WithSnapshots(p.snapshots))
 }
 
 // PathResolvers returns wrapped PathResolvers for Kubo.
@@ -60,7 +89,7 @@ func (p *nopfsPlugin) Options(info core.FXNodeInfo) ([]fx.Option, error) {
 
 	opts := append(
 		info.FXOptions,
-		fx.Provide(MakeBlocker),
+		fx.Provide(p.MakeBlocker),
 		fx.Decorate(ipfs.WrapBlockService),
 		fx.Decorate(ipfs.WrapNameSystem),
 		fx.Decorate(PathResolvers),
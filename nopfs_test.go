@@ -12,6 +12,7 @@ import (
 
 type testBlocker struct {
 	Blocker
+	opts []Option
 }
 
 type testHeader struct {
@@ -39,13 +40,16 @@ func (tb *testBlocker) ReadHeader(r io.Reader) (tester.Header, error) {
 }
 
 func (tb *testBlocker) ReadDenylist(r io.ReadSeekCloser) error {
-	tb.Blocker.Denylists = make(map[string]*Denylist)
-	dl, err := NewDenylistReader(r)
+	cfg := newBlockerConfig(tb.opts)
+	dl, err := newDenylist("test", r, cfg)
 	if err != nil {
 		return err
 	}
-	dl.Filename = "test"
-	tb.Blocker.Denylists["test"] = dl
+	if err := dl.parseAndFollow(false); err != nil {
+		return err
+	}
+	tb.Blocker.cfg = cfg
+	tb.Blocker.denylists = []*Denylist{dl}
 	return nil
 }
 
@@ -62,8 +66,21 @@ func (tb *testBlocker) IsCidBlocked(c cid.Cid) bool {
 func TestSuite(t *testing.T) {
 	logging.SetLogLevel("nopfs", "ERROR")
 
+	t.Run("memory", func(t *testing.T) {
+		testSuite(t)
+	})
+	t.Run("no bloom filter", func(t *testing.T) {
+		testSuite(t, WithBloomFilter(false))
+	})
+	t.Run("disk", func(t *testing.T) {
+		testSuite(t, WithBlocksDB(DiskBlocksDBFactory(t.TempDir())))
+	})
+}
+
+func testSuite(t *testing.T, opts ...Option) {
 	tb := testBlocker{
 		Blocker: Blocker{},
+		opts:    opts,
 	}
 
 	suite := &tester.Suite{
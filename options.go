@@ -0,0 +1,256 @@
+package nopfs
+
+import (
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Logger is the logging interface used by Blockers and Denylists. Loggers
+// from go-log (the default) and zap's SugaredLogger satisfy it.
+type Logger interface {
+	Debugf(template string, args ...interface{})
+	Infof(template string, args ...interface{})
+	Warnf(template string, args ...interface{})
+	Errorf(template string, args ...interface{})
+	Error(args ...interface{})
+}
+
+// ErrorPolicy controls how errors found when loading denylists are handled.
+type ErrorPolicy int
+
+// ErrorPolicy values.
+const (
+	// ErrorPolicyTolerant logs and skips rules that cannot be
+	// parsed. NewBlocker() only fails if none of the denylists can be
+	// loaded.
+	ErrorPolicyTolerant ErrorPolicy = iota
+	// ErrorPolicyStrict makes loading a denylist fail if any of its
+	// rules cannot be parsed, and NewBlocker() fail if any of the
+	// denylists cannot be loaded. Rules appended to followed denylists
+	// after they have been loaded are still logged and skipped when
+	// wrong. When a followed denylist is modified and cannot be reloaded
+	// without errors, the previous rules are kept.
+	ErrorPolicyStrict
+)
+
+// Option is a functional option to configure Blockers and Denylists.
+type Option func(*config)
+
+// config holds the options for Blockers and Denylists.
+type config struct {
+	follow           bool
+	safeCids         map[cid.Cid]string
+	legacyDoubleHash bool
+	logger           Logger
+	errorPolicy      ErrorPolicy
+	clock            func() time.Time
+	snapshots        bool
+	blocksDBFactory  BlocksDBFactory // nil for MemoryBlocksDBs
+	useBloomFilter   bool
+	parseWorkers     int
+	cacheSize        int
+
+	// bloom, cache and events are shared by the denylists of a Blocker
+	// (nil for standalone denylists).
+	bloom  *bloomFilter
+	cache  *lookupCache
+	events *eventBus
+
+	enabledCategories  map[string]struct{} // nil means all
+	disabledCategories map[string]struct{}
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		follow:           true,
+		safeCids:         SafeCids,
+		legacyDoubleHash: true,
+		logger:           logger,
+		errorPolicy:      ErrorPolicyTolerant,
+		clock:            time.Now,
+		useBloomFilter:   true,
+		parseWorkers:     runtime.GOMAXPROCS(0),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// newBlockerConfig returns the configuration for a Blocker and its
+// denylists.
+func newBlockerConfig(opts []Option) config {
+	cfg := newConfig(opts)
+	if cfg.useBloomFilter {
+		cfg.bloom = newBloomFilter()
+	}
+	if cfg.cacheSize > 0 {
+		cfg.cache = newLookupCache(cfg.cacheSize, cfg.clock)
+	}
+	cfg.events = newEventBus()
+	return cfg
+}
+
+// WithFollow controls whether the denylist files used by a Blocker are
+// followed for updates after loading them. Defaults to true. It is ignored
+// by NewDenylist(), which takes an explicit follow parameter, and by
+// NewDirBlocker(), which always follows.
+func WithFollow(follow bool) Option {
+	return func(cfg *config) {
+		cfg.follow = follow
+	}
+}
+
+// WithSafeCids sets the CIDs that should never be blocked, even if they
+// appear on a denylist. Defaults to SafeCids. A nil map disables this
+// safety net.
+func WithSafeCids(safeCids map[cid.Cid]string) Option {
+	return func(cfg *config) {
+		cfg.safeCids = safeCids
+	}
+}
+
+// WithLegacyDoubleHash controls whether lookups check for legacy
+// double-hashed rules (as used by the badbits list), which hash
+// "<cidv1b32>/<path>" with sha2-256. This costs an additional CID
+// conversion and hash per lookup and can be disabled when the denylists do
+// not use them. Defaults to true.
+func WithLegacyDoubleHash(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.legacyDoubleHash = enabled
+	}
+}
+
+// WithLogger sets the logger used by Blockers and Denylists. By default, the
+// "nopfs" go-log logger is used.
+func WithLogger(l Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = l
+	}
+}
+
+// WithErrorPolicy sets how errors loading denylists are handled. Defaults to
+// ErrorPolicyTolerant.
+func WithErrorPolicy(policy ErrorPolicy) Option {
+	return func(cfg *config) {
+		cfg.errorPolicy = policy
+	}
+}
+
+// WithClock sets the function used to obtain the current time when
+// evaluating rules with expires and not_before hints. Defaults to time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(cfg *config) {
+		cfg.clock = clock
+	}
+}
+
+// WithEnabledCategories makes lookups only consider rules with one of the
+// given categories (as set by the category hint) and rules without any
+// category. By default, all categories are enabled.
+func WithEnabledCategories(categories ...string) Option {
+	return func(cfg *config) {
+		cfg.enabledCategories = make(map[string]struct{}, len(categories))
+		for _, c := range categories {
+			cfg.enabledCategories[c] = struct{}{}
+		}
+	}
+}
+
+// WithDisabledCategories makes lookups ignore rules whose categories (as set
+// by the category hint) are all among the given ones. It can be combined
+// with WithEnabledCategories.
+func WithDisabledCategories(categories ...string) Option {
+	return func(cfg *config) {
+		cfg.disabledCategories = make(map[string]struct{}, len(categories))
+		for _, c := range categories {
+			cfg.disabledCategories[c] = struct{}{}
+		}
+	}
+}
+
+// categoryEnabled returns whether an Entry should be considered given its
+// categories. Entries with several categories (comma-separated) are
+// considered when any of them is enabled.
+func (cfg *config) categoryEnabled(e Entry) bool {
+	if cfg.enabledCategories == nil && cfg.disabledCategories == nil {
+		return true
+	}
+	categories, ok := e.Hint(HintCategory)
+	if !ok || categories == "" {
+		return true
+	}
+
+	for _, c := range strings.Split(categories, ",") {
+		if _, ok := cfg.disabledCategories[c]; ok {
+			continue
+		}
+		if cfg.enabledCategories == nil {
+			return true
+		}
+		if _, ok := cfg.enabledCategories[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithSnapshots enables snapshots for denylist files. After parsing a
+// denylist file, a compiled index of its rules is written next to it (see
+// SnapshotSuffix). When the denylist is opened again, the snapshot is
+// memory-mapped and only the lines appended to the file since are parsed,
+// which makes loading large denylists faster and uses less memory. The
+// snapshot is ignored (and re-written) when the file has changed in other
+// ways. Rules loaded from a snapshot are not part of Denylist.Entries.
+// Disabled by default.
+func WithSnapshots(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.snapshots = enabled
+	}
+}
+
+// WithBlocksDB sets the factory used to create the BlocksDBs that store the
+// rules of each Denylist. By default, rules are stored in memory
+// (MemoryBlocksDB). DiskBlocksDBFactory can be used to store them on disk
+// instead, using less memory at the cost of slower lookups.
+func WithBlocksDB(factory BlocksDBFactory) Option {
+	return func(cfg *config) {
+		cfg.blocksDBFactory = factory
+	}
+}
+
+// WithBloomFilter controls whether a Blocker keeps a bloom filter with the
+// keys of the CID rules (IPFS and double-hash rules) of its denylists, which
+// lets IsCidBlocked() answer that a CID is not blocked without consulting
+// every denylist. It takes around 10 bits of memory per rule. Enabled by
+// default. It is ignored by NewDenylist().
+func WithBloomFilter(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.useBloomFilter = enabled
+	}
+}
+
+// WithParseWorkers sets the number of goroutines used to parse the rules
+// that a denylist file contains when it is opened or reloaded. Rules
+// appended to followed denylists afterwards are parsed one by one as they
+// arrive. Defaults to GOMAXPROCS. A value of 1 disables parallel parsing.
+func WithParseWorkers(n int) Option {
+	return func(cfg *config) {
+		cfg.parseWorkers = n
+	}
+}
+
+// WithCache makes a Blocker keep the responses to up to the given number of
+// lookups (IsCidBlocked() and IsPathBlocked()) in an LRU cache. The cache is
+// invalidated whenever a rule is added to any of its denylists, they are
+// reloaded or rules become active or expire. Blocker.CacheStats() returns
+// hit and miss counters. Disabled (0) by default. It is ignored by
+// NewDenylist().
+func WithCache(size int) Option {
+	return func(cfg *config) {
+		cfg.cacheSize = size
+	}
+}
@@ -0,0 +1,315 @@
+package nopfs
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pathIndexThreshold is the number of Entries for a single key in a BlocksDB
+// from which they are indexed by path. Checking a few Entries one by one is
+// faster than using the index.
+const pathIndexThreshold = 16
+
+// pathIndex indexes Entries by their paths so that finding the Entries that
+// match a path does not require checking all of them: exact paths are
+// indexed in a map, prefixes in a trie and paths with wildcards in a
+// globIndex.
+//
+// Entries can be added while the index is checked, without locks, but not
+// concurrently with each other.
+type pathIndex struct {
+	exact    lookupMap[Entries]
+	prefixes *pathTrie
+	globs    globIndex
+}
+
+func newPathIndex() *pathIndex {
+	return &pathIndex{
+		prefixes: &pathTrie{},
+	}
+}
+
+func (pi *pathIndex) add(e Entry) {
+	switch {
+	case e.Path.IsGlob():
+		pi.globs.add(e)
+	case e.Path.Prefix:
+		pi.prefixes.insert(e.Path.Path, e)
+	default:
+		appendEntry(&pi.exact, e.Path.Path, e)
+	}
+}
+
+// checkPathStatus returns the status given by the last rule (by line
+// number) that matches the path, ignoring those for which skip returns
+// true.
+func (pi *pathIndex) checkPathStatus(p string, skip func(Entry) bool) (Status, Entry) {
+	p = strings.TrimSuffix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	status, entry := loadEntries(&pi.exact, p).checkPathStatus(p, skip)
+	st, e := pi.prefixes.checkPathStatus(p, skip)
+	status, entry = latestMatch(status, entry, st, e)
+	st, e = pi.globs.checkPathStatus(p, skip)
+	return latestMatch(status, entry, st, e)
+}
+
+// appendMatches appends all the rules that match the path to dst, ignoring
+// those for which skip returns true, and returns it.
+func (pi *pathIndex) appendMatches(dst Entries, p string, skip func(Entry) bool) Entries {
+	p = strings.TrimSuffix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	dst = loadEntries(&pi.exact, p).appendMatches(dst, p, skip)
+	dst = pi.prefixes.appendMatches(dst, p, skip)
+	return pi.globs.appendMatches(dst, p, skip)
+}
+
+// forEach calls fn for every Entry in the index. Entries under the same path
+// (or suffix) are visited in the order they were added.
+func (pi *pathIndex) forEach(fn func(Entry)) {
+	pi.exact.forEach(func(_ string, entries *Entries) {
+		for _, e := range *entries {
+			fn(e)
+		}
+	})
+	pi.prefixes.forEach(fn)
+	pi.globs.forEach(fn)
+}
+
+// removeExpired returns a new index without the entries that have expired at
+// the given time.
+func (pi *pathIndex) removeExpired(t time.Time) *pathIndex {
+	fresh := newPathIndex()
+	pi.forEach(func(e Entry) {
+		if !e.ExpiredAt(t) {
+			fresh.add(e)
+		}
+	})
+	return fresh
+}
+
+// loadEntries returns the Entries for key in m.
+func loadEntries(m *lookupMap[Entries], key string) Entries {
+	if entries := m.load(key); entries != nil {
+		return *entries
+	}
+	return nil
+}
+
+// appendEntry appends e to the Entries for key in m. They are replaced,
+// rather than modified, as they may be in use.
+func appendEntry(m *lookupMap[Entries], key string, e Entry) {
+	entries := append(loadEntries(m, key), e)
+	m.store(key, &entries)
+}
+
+// sharedEntries holds Entries that can be read while new ones are added:
+// they are replaced, rather than modified, when that happens.
+type sharedEntries struct {
+	v atomic.Value // Entries
+}
+
+func (se *sharedEntries) load() Entries {
+	entries, _ := se.v.Load().(Entries)
+	return entries
+}
+
+func (se *sharedEntries) set(entries Entries) {
+	se.v.Store(entries)
+}
+
+func (se *sharedEntries) add(e Entry) {
+	// Readers do not look beyond the length of the Entries they
+	// loaded, so appending to the same array is safe.
+	se.set(append(se.load(), e))
+}
+
+// pathTrie is a radix tree of prefix rules, keyed by their paths. Checking a
+// path walks the tree along the path, visiting only the rules whose prefix
+// matches.
+//
+// Nodes are not modified once they are in the tree, other than adding
+// entries and children to them, so lookups can walk it while rules are
+// inserted.
+type pathTrie struct {
+	label    string // part of the key leading to this node
+	entries  sharedEntries
+	children lookupMap[pathTrie] // by first byte of their label
+}
+
+func (t *pathTrie) insert(key string, e Entry) {
+	n := t
+	for {
+		if key == "" {
+			n.entries.add(e)
+			return
+		}
+		child := n.children.load(key[:1])
+		if child == nil {
+			child = &pathTrie{label: key}
+			child.entries.add(e)
+			n.children.store(key[:1], child)
+			return
+		}
+
+		l := commonPrefixLen(key, child.label)
+		if l < len(child.label) {
+			// Split the child, replacing it with an
+			// intermediate node with the common part of the
+			// label, which leads to a copy of the child with
+			// the rest.
+			rest := &pathTrie{label: child.label[l:]}
+			rest.entries.set(child.entries.load())
+			child.children.forEach(rest.children.store)
+			mid := &pathTrie{label: child.label[:l]}
+			mid.children.store(rest.label[:1], rest)
+			n.children.store(key[:1], mid)
+			child = mid
+		}
+		key = key[l:]
+		n = child
+	}
+}
+
+// checkPathStatus returns the status given by the last rule (by line
+// number) that is a prefix of the path, ignoring those for which skip
+// returns true.
+func (t *pathTrie) checkPathStatus(p string, skip func(Entry) bool) (Status, Entry) {
+	status, entry := t.entries.load().checkPathStatus(p, skip)
+	n := t
+	rest := p
+	for rest != "" {
+		child := n.children.load(rest[:1])
+		if child == nil || !strings.HasPrefix(rest, child.label) {
+			break
+		}
+		rest = rest[len(child.label):]
+		n = child
+		st, e := n.entries.load().checkPathStatus(p, skip)
+		status, entry = latestMatch(status, entry, st, e)
+	}
+	return status, entry
+}
+
+// appendMatches appends the rules that are a prefix of the path to dst,
+// ignoring those for which skip returns true, and returns it.
+func (t *pathTrie) appendMatches(dst Entries, p string, skip func(Entry) bool) Entries {
+	dst = t.entries.load().appendMatches(dst, p, skip)
+	n := t
+	rest := p
+	for rest != "" {
+		child := n.children.load(rest[:1])
+		if child == nil || !strings.HasPrefix(rest, child.label) {
+			break
+		}
+		rest = rest[len(child.label):]
+		n = child
+		dst = n.entries.load().appendMatches(dst, p, skip)
+	}
+	return dst
+}
+
+func (t *pathTrie) forEach(fn func(Entry)) {
+	for _, e := range t.entries.load() {
+		fn(e)
+	}
+	t.children.forEach(func(_ string, child *pathTrie) {
+		child.forEach(fn)
+	})
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// globIndex indexes path rules with wildcards so that a path lookup does not
+// need to check every rule. Rules are indexed by the literal suffix of their
+// last segment (see BlockedPath.indexSuffix), and lookups only check the
+// rules indexed by a suffix of the last segment of the path. Rules without
+// such suffix are checked one by one.
+type globIndex struct {
+	bySuffix lookupMap[Entries]
+	others   sharedEntries
+}
+
+func (gi *globIndex) add(e Entry) {
+	suffix := e.Path.indexSuffix()
+	if suffix == "" {
+		gi.others.add(e)
+		return
+	}
+	appendEntry(&gi.bySuffix, suffix, e)
+}
+
+// checkPathStatus returns the status given by the last rule (by line
+// number) that matches the path, ignoring those for which skip returns
+// true.
+func (gi *globIndex) checkPathStatus(p string, skip func(Entry) bool) (Status, Entry) {
+	p = strings.TrimSuffix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	status, entry := gi.others.load().checkPathStatus(p, skip)
+	if gi.bySuffix.empty() {
+		return status, entry
+	}
+
+	lastSegment := p
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		lastSegment = p[i+1:]
+	}
+	for i := 0; i < len(lastSegment); i++ {
+		entries := gi.bySuffix.load(lastSegment[i:])
+		if entries == nil {
+			continue
+		}
+		st, e := entries.checkPathStatus(p, skip)
+		status, entry = latestMatch(status, entry, st, e)
+	}
+	return status, entry
+}
+
+// appendMatches appends the rules that match the path to dst, ignoring
+// those for which skip returns true, and returns it.
+func (gi *globIndex) appendMatches(dst Entries, p string, skip func(Entry) bool) Entries {
+	p = strings.TrimSuffix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	dst = gi.others.load().appendMatches(dst, p, skip)
+	lastSegment := p
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		lastSegment = p[i+1:]
+	}
+	for i := 0; i < len(lastSegment) && !gi.bySuffix.empty(); i++ {
+		dst = loadEntries(&gi.bySuffix, lastSegment[i:]).appendMatches(dst, p, skip)
+	}
+	return dst
+}
+
+func (gi *globIndex) forEach(fn func(Entry)) {
+	gi.bySuffix.forEach(func(_ string, entries *Entries) {
+		for _, e := range *entries {
+			fn(e)
+		}
+	})
+	for _, e := range gi.others.load() {
+		fn(e)
+	}
+}
+
+// latestMatch returns the status and entry corresponding to the rule that
+// appears last in the denylist. Later rules have preference.
+func latestMatch(status1 Status, entry1 Entry, status2 Status, entry2 Entry) (Status, Entry) {
+	if status2 == StatusNotFound {
+		return status1, entry1
+	}
+	if status1 == StatusNotFound || entry2.Line > entry1.Line {
+		return status2, entry2
+	}
+	return status1, entry1
+}
@@ -0,0 +1,103 @@
+package nopfs
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestPathIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	segments := []string{"a", "ab", "b", "index.html", "x.exe", ""}
+	randomPath := func() string {
+		n := rng.Intn(4)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = segments[rng.Intn(len(segments))]
+		}
+		return strings.Join(parts, "/")
+	}
+
+	var entries Entries
+	pi := newPathIndex()
+	for i := 0; i < 500; i++ {
+		rule := randomPath()
+		switch rng.Intn(5) {
+		case 0:
+			rule += "*"
+		case 1:
+			rule += "/*"
+		case 2:
+			rule = "**/" + rule
+		case 3:
+			rule = "*" + rule
+		}
+		bp, err := NewBlockedPath(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := Entry{
+			Line:      uint64(i + 1),
+			AllowRule: rng.Intn(2) == 0,
+			RawValue:  rule,
+			Path:      bp,
+		}
+		entries = append(entries, e)
+		pi.add(e)
+	}
+
+	noSkip := func(Entry) bool { return false }
+	for i := 0; i < 2000; i++ {
+		p := randomPath()
+		st1, e1 := entries.checkPathStatus(p, noSkip)
+		st2, e2 := pi.checkPathStatus(p, noSkip)
+		if st1 != st2 || e1.Line != e2.Line {
+			t.Fatalf("%s: linear: %s (%s), index: %s (%s)", p, st1, e1.RawValue, st2, e2.RawValue)
+		}
+	}
+}
+
+func TestPathTrie(t *testing.T) {
+	var trie pathTrie
+	for i, key := range []string{"", "abc", "ab", "abd", "b", "abcdef"} {
+		bp, _ := NewBlockedPath(key + "*")
+		trie.insert(bp.Path, Entry{Line: uint64(i + 1), Path: bp})
+	}
+
+	noSkip := func(Entry) bool { return false }
+	for p, line := range map[string]uint64{
+		"abcdefg": 6,
+		"abce":    3, // ab is a later rule than abc
+		"abd/x":   4,
+		"ab":      3,
+		"a":       1,
+		"c":       1,
+	} {
+		_, e := trie.checkPathStatus(p, noSkip)
+		if e.Line != line {
+			t.Errorf("%s: expected line %d, got %d", p, line, e.Line)
+		}
+	}
+}
+
+func BenchmarkPrefixRules(b *testing.B) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	var sb strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&sb, "/ipfs/%s/dir%d/*\n", testCid1, i)
+		fmt.Fprintf(&sb, "/dir%d/*\n", i)
+	}
+	dl, err := NewDenylistReader(testReader{strings.NewReader(sb.String())})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dl.IsIPFSPathBlocked(testCid1.String(), "dir9999/file")
+	}
+}
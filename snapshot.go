@@ -0,0 +1,718 @@
+package nopfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Snapshots are compiled indexes of the rules in a denylist file, written
+// next to it (with SnapshotSuffix appended to its name). They record how
+// much of the file they cover so that, on the next start, the Denylist can
+// memory-map the snapshot instead of parsing the whole file again, and only
+// parse the lines that were appended afterwards. They also record a sha256
+// of the part of the file they cover: it is hashed on start, which is much
+// cheaper than parsing it, to detect any edits made while stopped.
+//
+// Snapshots contain a table of fixed-size records, sorted by key, which point
+// to the rules, stored already parsed (see appendSnapshotEntry). Lookups
+// perform a binary search on the table and only decode the rules that are
+// found.
+//
+// While following the file, the rules appended after the part covered by
+// the snapshot are collected to rewrite it once they amount to
+// snapshotRewriteSize bytes of the file, or when the Denylist is closed, so
+// that they are not parsed again on every start.
+//
+// Layout (little-endian):
+//
+//	magic "NOPFSSNP" | version u32 | number of double-hash codes u32 |
+//	offset covered u64 | line number u64 | number of records u64 |
+//	header length u32 | last line length u32 | blob length u64 |
+//	sha256 of the covered part of the file [32]byte |
+//	double-hash codes u64... | header | last line | padding to 8 bytes |
+//	records | blob
+//
+// where each record is: key offset u64 | key length u32 | rule length u32 |
+// rule offset u64 | line number u64, with offsets pointing to the blob.
+
+// SnapshotSuffix is appended to the name of a denylist file to obtain the
+// name of its snapshot.
+const SnapshotSuffix = ".snapshot"
+
+const (
+	snapshotMagic      = "NOPFSSNP"
+	snapshotVersion    = 4
+	snapshotHeaderSize = 88
+	snapshotRecordSize = 32
+)
+
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// snapshotRewriteSize is how much a followed denylist file can grow past the
+// part covered by its snapshot before the snapshot is rewritten.
+var snapshotRewriteSize int64 = 1 << 20
+
+// snapshotKey returns the key under which rules are stored in a snapshot.
+func snapshotKey(kind indexKind, mhCode uint64, key string) string {
+	if kind == indexDoubleHash {
+		return string(kind) + strconv.FormatUint(mhCode, 10) + ":" + key
+	}
+	return string(kind) + key
+}
+
+type snapshotRecord struct {
+	key   string
+	entry []byte // see appendSnapshotEntry
+	line  uint64
+}
+
+// snapshotWriter collects the rules parsed from a denylist file to write a
+// snapshot. When base is set, the rules only cover the part of the file
+// after the snapshot identified by baseOffset and baseSum, which is merged
+// with them when writing.
+type snapshotWriter struct {
+	records []snapshotRecord
+	codes   map[uint64]struct{}
+
+	base       bool
+	baseOffset int64
+	baseSum    []byte
+
+	// The part of the file whose rules have all been collected, set
+	// by mark.
+	n          int // records
+	offset     int64
+	lineNumber uint64
+	lastLine   string
+	sum        []byte
+}
+
+func newSnapshotWriter() *snapshotWriter {
+	return &snapshotWriter{
+		codes: make(map[uint64]struct{}),
+	}
+}
+
+// newSnapshotWriterAfter returns a snapshotWriter for the rules that follow
+// the part of the file covered by a snapshot.
+func newSnapshotWriterAfter(offset int64, sum []byte) *snapshotWriter {
+	sw := newSnapshotWriter()
+	sw.base = true
+	sw.baseOffset = offset
+	sw.baseSum = bytes.Clone(sum)
+	return sw
+}
+
+func (sw *snapshotWriter) add(indexed []indexedEntry, line uint64) {
+	for _, ie := range indexed {
+		if ie.kind == indexDoubleHash {
+			sw.codes[ie.mhCode] = struct{}{}
+		}
+		sw.records = append(sw.records, snapshotRecord{
+			key:   snapshotKey(ie.kind, ie.mhCode, ie.key),
+			entry: appendSnapshotEntry(nil, ie.entry),
+			line:  line,
+		})
+	}
+}
+
+// mark records that the rules collected so far are those of the file up to
+// the position of the lineReader.
+func (sw *snapshotWriter) mark(lr *lineReader) {
+	sw.n = len(sw.records)
+	sw.offset = lr.offset
+	sw.lineNumber = lr.lineNumber
+	sw.lastLine = lr.lastLine
+	sw.sum = lr.sum.Sum(nil)
+}
+
+// pending returns how many bytes of the file, up to the mark, are not
+// covered by the snapshot file.
+func (sw *snapshotWriter) pending() int64 {
+	return sw.offset - sw.baseOffset
+}
+
+// write writes the snapshot, covering the file up to the mark. The file is
+// written to a temporary file first and renamed.
+func (sw *snapshotWriter) write(fname string, header DenylistHeader) error {
+	records := sw.records[:sw.n]
+	// Records with the same key keep the order of the lines.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+	codes := make([]uint64, 0, len(sw.codes))
+	for code := range sw.codes {
+		codes = append(codes, code)
+	}
+
+	if sw.base {
+		base, err := openSnapshot(fname)
+		if err != nil {
+			return err
+		}
+		defer base.close()
+		if base.offset != sw.baseOffset || !bytes.Equal(base.sum, sw.baseSum) {
+			return errors.New("snapshot replaced since it was loaded")
+		}
+		records = base.merge(records)
+		for _, code := range base.codes {
+			if _, ok := sw.codes[code]; !ok {
+				codes = append(codes, code)
+			}
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	// Keys go to the blob after the rules.
+	var blob []byte
+	entryOffs := make([]uint64, len(records))
+	for i, r := range records {
+		entryOffs[i] = uint64(len(blob))
+		blob = append(blob, r.entry...)
+	}
+	keyOffs := make([]uint64, len(records))
+	for i, r := range records {
+		keyOffs[i] = uint64(len(blob))
+		blob = append(blob, r.key...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	le := binary.LittleEndian
+	u32 := func(v uint32) {
+		var b [4]byte
+		le.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+	u64 := func(v uint64) {
+		var b [8]byte
+		le.PutUint64(b[:], v)
+		buf.Write(b[:])
+	}
+	u32(snapshotVersion)
+	u32(uint32(len(codes)))
+	u64(uint64(sw.offset))
+	u64(sw.lineNumber)
+	u64(uint64(len(records)))
+	u32(uint32(len(header.headerBytes)))
+	u32(uint32(len(sw.lastLine)))
+	u64(uint64(len(blob)))
+	buf.Write(sw.sum)
+	for _, code := range codes {
+		u64(code)
+	}
+	buf.Write(header.headerBytes)
+	buf.WriteString(sw.lastLine)
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+	for i, r := range records {
+		u64(keyOffs[i])
+		u32(uint32(len(r.key)))
+		u32(uint32(len(r.entry)))
+		u64(entryOffs[i])
+		u64(r.line)
+	}
+	buf.Write(blob)
+
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fname); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// snapshot is a memory-mapped snapshot file.
+type snapshot struct {
+	data  []byte
+	unmap func() error
+
+	offset      int64
+	lineNumber  uint64
+	headerBytes []byte
+	lastLine    string
+	sum         []byte
+	codes       []uint64
+
+	records []byte
+	blob    []byte
+	n       int
+
+	// headerHints are the hints in the header of the denylist, used to
+	// decode the rules in the snapshot. Lookups cannot use the Header of
+	// the Denylist, which changes on reloads.
+	headerHints map[string]string
+}
+
+// openSnapshot memory-maps and validates a snapshot file.
+func openSnapshot(fname string) (*snapshot, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, unmap, err := mmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{
+		data:  data,
+		unmap: unmap,
+	}
+	if err := snap.decode(); err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return snap, nil
+}
+
+func (snap *snapshot) decode() error {
+	data := snap.data
+	if len(data) < snapshotHeaderSize || string(data[:8]) != snapshotMagic {
+		return errInvalidSnapshot
+	}
+	le := binary.LittleEndian
+	if le.Uint32(data[8:]) != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version", errInvalidSnapshot)
+	}
+	numCodes := uint64(le.Uint32(data[12:]))
+	snap.offset = int64(le.Uint64(data[16:]))
+	snap.lineNumber = le.Uint64(data[24:])
+	numRecords := le.Uint64(data[32:])
+	headerLen := uint64(le.Uint32(data[40:]))
+	lastLineLen := uint64(le.Uint32(data[44:]))
+	blobLen := le.Uint64(data[48:])
+	snap.sum = data[56:snapshotHeaderSize]
+
+	pos := uint64(snapshotHeaderSize)
+	size := uint64(len(data))
+	if numCodes > size || numRecords > size || blobLen > size {
+		return errInvalidSnapshot
+	}
+	recordsPos := pos + numCodes*8 + headerLen + lastLineLen
+	recordsPos = (recordsPos + 7) &^ 7
+	if recordsPos+numRecords*snapshotRecordSize+blobLen != size {
+		return errInvalidSnapshot
+	}
+
+	for i := uint64(0); i < numCodes; i++ {
+		snap.codes = append(snap.codes, le.Uint64(data[pos:]))
+		pos += 8
+	}
+	snap.headerBytes = data[pos : pos+headerLen]
+	pos += headerLen
+	snap.lastLine = string(data[pos : pos+lastLineLen])
+
+	snap.records = data[recordsPos : recordsPos+numRecords*snapshotRecordSize]
+	snap.blob = data[recordsPos+numRecords*snapshotRecordSize:]
+	snap.n = int(numRecords)
+
+	for i := 0; i < snap.n; i++ {
+		keyOff, keyLen, entryOff, entryLen, _ := snap.record(i)
+		// Written this way so that the sums cannot overflow.
+		if keyOff > blobLen || keyLen > blobLen-keyOff ||
+			entryOff > blobLen || entryLen > blobLen-entryOff {
+			return errInvalidSnapshot
+		}
+	}
+	return nil
+}
+
+func (snap *snapshot) record(i int) (keyOff, keyLen, entryOff, entryLen, line uint64) {
+	le := binary.LittleEndian
+	r := snap.records[i*snapshotRecordSize : (i+1)*snapshotRecordSize]
+	return le.Uint64(r), uint64(le.Uint32(r[8:])), le.Uint64(r[16:]), uint64(le.Uint32(r[12:])), le.Uint64(r[24:])
+}
+
+func (snap *snapshot) key(i int) []byte {
+	keyOff, keyLen, _, _, _ := snap.record(i)
+	return snap.blob[keyOff : keyOff+keyLen]
+}
+
+// entry decodes the rule of a record.
+func (snap *snapshot) entry(i int) (Entry, error) {
+	_, _, entryOff, entryLen, line := snap.record(i)
+	return decodeSnapshotEntry(snap.blob[entryOff:entryOff+entryLen], line, snap.headerHints)
+}
+
+// forEach calls fn with the records whose key is the given one, or starts
+// with it when prefix is true, in order.
+func (snap *snapshot) forEach(key string, prefix bool, fn func(i int)) {
+	i := sort.Search(snap.n, func(i int) bool {
+		return string(snap.key(i)) >= key
+	})
+	for ; i < snap.n; i++ {
+		k := snap.key(i)
+		if prefix && !bytes.HasPrefix(k, []byte(key)) || !prefix && string(k) != key {
+			return
+		}
+		fn(i)
+	}
+}
+
+// merge returns the records of the snapshot followed, for each key, by the
+// given ones, which must be sorted by key and come from later lines. The
+// rules of the returned records point to the snapshot, which must stay open
+// while they are used.
+func (snap *snapshot) merge(records []snapshotRecord) []snapshotRecord {
+	merged := make([]snapshotRecord, 0, snap.n+len(records))
+	j := 0
+	for i := 0; i < snap.n; i++ {
+		key := snap.key(i)
+		for j < len(records) && records[j].key < string(key) {
+			merged = append(merged, records[j])
+			j++
+		}
+		_, _, entryOff, entryLen, line := snap.record(i)
+		merged = append(merged, snapshotRecord{
+			key:   string(key),
+			entry: snap.blob[entryOff : entryOff+entryLen],
+			line:  line,
+		})
+	}
+	return append(merged, records[j:]...)
+}
+
+func (snap *snapshot) close() error {
+	return snap.unmap()
+}
+
+// errSnapshotStale is returned when the part of the source file covered by
+// a snapshot has changed.
+var errSnapshotStale = errors.New("denylist changed since the snapshot was written")
+
+// snapshotSum returns the hash of the part of the source file covered by a
+// snapshot, to continue hashing the file after it, or errSnapshotStale if
+// that part has changed.
+func snapshotSum(f *os.File, header DenylistHeader, snap *snapshot) (hash.Hash, error) {
+	if !bytes.Equal(header.headerBytes, snap.headerBytes) {
+		return nil, errSnapshotStale
+	}
+	changed, err := sourceChanged(f, header, snap.offset, snap.lastLine)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		return nil, errSnapshotStale
+	}
+
+	// Lines may have been edited in the middle.
+	sum, err := sumFile(f, snap.offset)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum.Sum(nil), snap.sum) {
+		return nil, errSnapshotStale
+	}
+	return sum, nil
+}
+
+// loadSnapshot opens the snapshot for the denylist file and starts using it
+// for lookups if it matches the file. It returns a lineReader to continue
+// parsing the file after the part covered by the snapshot. The caller must
+// hold the lock.
+func (dl *Denylist) loadSnapshot() (*lineReader, error) {
+	f, ok := dl.f.(*os.File)
+	if !ok {
+		return nil, errors.New("snapshots are only supported for files")
+	}
+
+	snap, err := openSnapshot(dl.Filename + SnapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := snapshotSum(f, dl.Header, snap)
+	if err == nil {
+		_, err = f.Seek(snap.offset, io.SeekStart)
+	}
+	if err != nil {
+		snap.close()
+		return nil, err
+	}
+
+	snap.headerHints = dl.Header.Hints
+
+	// Path patterns need to be in memory.
+	snap.forEach(string(indexPathPattern), true, func(i int) {
+		e, err := snap.entry(i)
+		if err != nil {
+			dl.cfg.logger.Errorf("%s: %s", dl.Filename, err)
+			return
+		}
+		ie := indexedEntry{kind: indexPathPattern, key: string(snap.key(i)[1:]), entry: e}
+		if err := dl.storeEntry(ie); err != nil {
+			dl.cfg.logger.Error(err)
+		}
+	})
+	if dl.cfg.bloom != nil {
+		if err := dl.addSnapshotKeysToBloom(snap); err != nil {
+			snap.close()
+			return nil, err
+		}
+	}
+	// Lookups iterate the double-hash DBs to know which hashing
+	// functions are used.
+	for _, code := range snap.codes {
+		if _, err := dl.doubleHashBlocksDB(code); err != nil {
+			snap.close()
+			return nil, err
+		}
+	}
+	dl.snapshot = snap
+	dl.snapshotWriter = newSnapshotWriterAfter(snap.offset, snap.sum)
+	dl.publish()
+
+	lr := newLineReader(f, snap.lineNumber, snap.offset)
+	lr.lastLine = snap.lastLine
+	lr.sum = sum
+	dl.cfg.logger.Infof("%s: loaded snapshot covering %d lines", dl.Filename, snap.lineNumber)
+	return lr, nil
+}
+
+// addSnapshotKeysToBloom adds the keys of the IPFS and double-hash rules in
+// a snapshot to the bloom filter.
+func (dl *Denylist) addSnapshotKeysToBloom(snap *snapshot) error {
+	for i := 0; i < snap.n; i++ {
+		k := snap.key(i)
+		if len(k) == 0 {
+			return errInvalidSnapshot
+		}
+		var mh []byte
+		switch indexKind(k[0]) {
+		case indexIPFS:
+			mh = k[1:]
+		case indexDoubleHash:
+			_, mh, _ = bytes.Cut(k, []byte(":"))
+		default:
+			continue
+		}
+		dl.cfg.bloom.add(mh)
+	}
+	return nil
+}
+
+// writeSnapshot is called when the lineReader reaches the end of the file.
+// When rules are being collected, it writes a snapshot with the rules parsed
+// so far, covering the file up to the position of the lineReader, unless the
+// part of the file that the current snapshot does not cover is under
+// snapshotRewriteSize. Afterwards, rules keep being collected to rewrite it.
+func (dl *Denylist) writeSnapshot(lr *lineReader) {
+	dl.mu.Lock()
+	sw := dl.snapshotWriter
+	if sw == nil {
+		dl.mu.Unlock()
+		return
+	}
+	sw.mark(lr)
+	if sw.base && sw.pending() < snapshotRewriteSize {
+		dl.mu.Unlock()
+		return
+	}
+	dl.snapshotWriter = nil
+	header := dl.Header
+	dl.mu.Unlock()
+
+	if !dl.flushSnapshot(sw, header) {
+		return
+	}
+	dl.mu.Lock()
+	if !dl.closed {
+		dl.snapshotWriter = newSnapshotWriterAfter(sw.offset, sw.sum)
+	}
+	dl.mu.Unlock()
+}
+
+// flushSnapshot writes the snapshot with the rules collected by a
+// snapshotWriter and returns whether it succeeded.
+func (dl *Denylist) flushSnapshot(sw *snapshotWriter, header DenylistHeader) bool {
+	fname := dl.Filename + SnapshotSuffix
+	if err := sw.write(fname, header); err != nil {
+		dl.cfg.logger.Warnf("%s: error writing snapshot: %s", dl.Filename, err)
+		return false
+	}
+	dl.cfg.logger.Infof("%s: wrote snapshot covering %d lines", dl.Filename, sw.lineNumber)
+	return true
+}
+
+// checkSnapshot returns the status given by the rules in the snapshot stored
+// under the given key.
+func (dl *Denylist) checkSnapshot(snap *snapshot, kind indexKind, mhCode uint64, key, p string) (Status, Entry) {
+	return dl.snapshotEntries(snap, kind, mhCode, key).checkPathStatus(p, dl.skip)
+}
+
+// snapshotEntries returns the rules stored under a key of an index in the
+// snapshot.
+func (dl *Denylist) snapshotEntries(snap *snapshot, kind indexKind, mhCode uint64, key string) Entries {
+	var entries Entries
+	snap.forEach(snapshotKey(kind, mhCode, key), false, func(i int) {
+		e, err := snap.entry(i)
+		if err != nil {
+			dl.cfg.logger.Errorf("%s: %s", dl.Filename, err)
+			return
+		}
+		entries = append(entries, e)
+	})
+	return entries
+}
+
+// Flags of the rules stored in snapshots.
+const (
+	snapshotAllowRule = 1 << iota
+	snapshotPrefix
+)
+
+// appendSnapshotEntry appends the encoding of a parsed rule, as stored in
+// snapshots, to b:
+//
+//	flags u8 | not before | expires | raw line | multihash | path |
+//	number of glob tokens | (type u8 | literal)... |
+//	number of hints | (key | value)...
+//
+// where numbers are uvarints, times are encoded with MarshalBinary (empty
+// when zero) and every other field is prefixed with its length as a
+// uvarint. The header hints are not included.
+func appendSnapshotEntry(b []byte, e Entry) []byte {
+	var flags byte
+	if e.AllowRule {
+		flags |= snapshotAllowRule
+	}
+	if e.Path.Prefix {
+		flags |= snapshotPrefix
+	}
+	b = append(b, flags)
+	b = appendSnapshotTime(b, e.NotBefore)
+	b = appendSnapshotTime(b, e.Expires)
+	b = appendSnapshotString(b, e.RawValue)
+	b = appendSnapshotString(b, string(e.Multihash))
+	b = appendSnapshotString(b, e.Path.Path)
+	b = appendUvarint(b, uint64(len(e.Path.glob)))
+	for _, tk := range e.Path.glob {
+		b = append(b, byte(tk.typ))
+		b = appendSnapshotString(b, tk.literal)
+	}
+	b = appendUvarint(b, uint64(len(e.RuleHints)))
+	for k, v := range e.RuleHints {
+		b = appendSnapshotString(b, k)
+		b = appendSnapshotString(b, v)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendSnapshotString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendSnapshotTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return appendUvarint(b, 0)
+	}
+	tb, _ := t.MarshalBinary()
+	return appendSnapshotString(b, string(tb))
+}
+
+// snapshotDecoder reads the fields written by appendSnapshotEntry. Reading
+// past the end sets failed.
+type snapshotDecoder struct {
+	b      []byte
+	failed bool
+}
+
+func (d *snapshotDecoder) byte() byte {
+	if len(d.b) == 0 {
+		d.failed = true
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.failed = true
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *snapshotDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.failed = true
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *snapshotDecoder) time() time.Time {
+	var t time.Time
+	if b := d.bytes(); len(b) > 0 && t.UnmarshalBinary(b) != nil {
+		d.failed = true
+	}
+	return t
+}
+
+// decodeSnapshotEntry decodes a rule written by appendSnapshotEntry.
+func decodeSnapshotEntry(b []byte, line uint64, headerHints map[string]string) (Entry, error) {
+	d := snapshotDecoder{b: b}
+	flags := d.byte()
+	e := Entry{
+		Line:        line,
+		AllowRule:   flags&snapshotAllowRule != 0,
+		NotBefore:   d.time(),
+		Expires:     d.time(),
+		RawValue:    string(d.bytes()),
+		headerHints: headerHints,
+	}
+	if mh := d.bytes(); len(mh) > 0 {
+		e.Multihash = bytes.Clone(mh)
+	}
+	e.Path.Path = string(d.bytes())
+	e.Path.Prefix = flags&snapshotPrefix != 0
+	for n := d.uvarint(); n > 0 && !d.failed; n-- {
+		typ := globTokenType(d.byte())
+		e.Path.glob = append(e.Path.glob, globToken{typ: typ, literal: string(d.bytes())})
+	}
+	for n := d.uvarint(); n > 0 && !d.failed; n-- {
+		if e.RuleHints == nil {
+			e.RuleHints = make(map[string]string)
+		}
+		k := string(d.bytes())
+		e.RuleHints[k] = string(d.bytes())
+	}
+	if d.failed || len(d.b) > 0 {
+		return Entry{}, fmt.Errorf("%w: malformed rule for line %d", errInvalidSnapshot, line)
+	}
+	return e, nil
+}
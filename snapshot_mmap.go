@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package nopfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps a file in memory for reading. The returned function unmaps
+// it.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	if size <= 0 {
+		return nil, nil, errors.New("cannot map an empty file")
+	}
+	if int64(int(size)) != size {
+		return nil, nil, errors.New("file too large to map")
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
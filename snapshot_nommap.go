@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package nopfs
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads a file in memory on platforms where we do not memory-map
+// files.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,330 @@
+package nopfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestSnapshots(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	legacyCid := cid.MustParse("bafybeiefwqslmf6zyyrxodaxx4vwqircuxpza5ri45ws3y5a62ypxti42e")
+	content := `name: test
+hints:
+  gateway_status: 451
+---
+/ipfs/` + testCid1.String() + `
+/ipfs/` + testCid2.String() + `/sub/*
++/ipfs/` + testCid2.String() + `/sub/allowed
+/ipns/example.com
+//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7
+/exact/path
+**.exe
+`
+	writeTestDenylist(t, fpath, content)
+
+	expected := map[string]Status{
+		"/ipfs/" + testCid1.String():                     StatusBlocked,
+		"/ipfs/" + testCid2.String() + "/sub/a":          StatusBlocked,
+		"/ipfs/" + testCid2.String() + "/sub/allowed":    StatusAllowed,
+		"/ipfs/" + testCid3.String():                     StatusNotFound,
+		"/ipns/example.com":                              StatusBlocked,
+		"/ipfs/" + legacyCid.String():                    StatusBlocked,
+		"/ipfs/" + testCid3.String() + "/exact/path":     StatusBlocked,
+		"/ipfs/" + testCid3.String() + "/a/b/setup.exe":  StatusBlocked,
+		"/ipfs/" + testCid3.String() + "/a/b/setup.txt":  StatusNotFound,
+		"/ipfs/" + testCid3.String() + "/appended/path":  StatusNotFound,
+		"/ipfs/" + testCid3.String() + "/appended/other": StatusNotFound,
+	}
+	check := func(dl *Denylist) {
+		t.Helper()
+		for p, st := range expected {
+			pp, err := path.NewPath(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := dl.IsPathBlocked(pp)
+			if resp.Status != st {
+				t.Errorf("%s: expected %s, got %s", p, st, resp)
+			}
+			if st == StatusBlocked && resp.HTTPStatus() != 451 {
+				t.Errorf("%s: header hints should apply", p)
+			}
+		}
+	}
+
+	// First load writes the snapshot.
+	dl, err := NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.snapshot != nil {
+		t.Error("no snapshot should be loaded the first time")
+	}
+	check(dl)
+	dl.Close()
+	if _, err := os.Stat(fpath + SnapshotSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appended rules are parsed on top of the snapshot.
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("/appended/path\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["/ipfs/"+testCid3.String()+"/appended/path"] = StatusBlocked
+
+	dl, err = NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.snapshot == nil {
+		t.Fatal("snapshot should be loaded")
+	}
+	if n := len(dl.Entries); n != 1 {
+		t.Errorf("only the appended rule should be parsed, got %d", n)
+	}
+	check(dl)
+	dl.Close()
+
+	// Closing rewrote the snapshot to cover the appended rule.
+	dl, err = NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(dl.Entries); dl.snapshot == nil || n != 0 {
+		t.Errorf("the rewritten snapshot should cover every rule, %d parsed", n)
+	}
+	check(dl)
+	dl.Close()
+
+	// Modified files are fully parsed and the snapshot re-written.
+	content = strings.Replace(content, "name: test", "name: changed", 1) + "/appended/other\n"
+	writeTestDenylist(t, fpath, content)
+	expected["/ipfs/"+testCid3.String()+"/appended/path"] = StatusNotFound
+	expected["/ipfs/"+testCid3.String()+"/appended/other"] = StatusBlocked
+
+	dl, err = NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.snapshot != nil {
+		t.Error("snapshot should not be used after the file changed")
+	}
+	check(dl)
+	dl.Close()
+
+	dl, err = NewDenylist(fpath, true, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid1) })
+	dl.mu.RLock()
+	loaded := dl.snapshot != nil
+	dl.mu.RUnlock()
+	if !loaded {
+		t.Error("re-written snapshot should be loaded")
+	}
+	check(dl)
+
+	// Corrupted snapshots are ignored.
+	if err := os.WriteFile(fpath+SnapshotSuffix, []byte("NOPFSSNP garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dl2, err := NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dl2)
+	dl2.Close()
+}
+
+func TestSnapshotEditedInTheMiddle(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid2.String()+"\n/ipfs/"+testCid1.String()+"\n")
+	dl, err := NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.Close()
+
+	// Same size, same last line.
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid3.String()+"\n/ipfs/"+testCid1.String()+"\n")
+	dl, err = NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	if dl.snapshot != nil {
+		t.Error("snapshot should not be used after the file changed")
+	}
+	if resp := dl.IsCidBlocked(testCid2); resp.Status != StatusNotFound {
+		t.Errorf("removed rule should not apply: %s", resp)
+	}
+	if resp := dl.IsCidBlocked(testCid3); resp.Status != StatusBlocked {
+		t.Errorf("new rule should apply: %s", resp)
+	}
+}
+
+func TestSnapshotCorruptedRecord(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid1.String()+"\n")
+	dl, err := NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.Close()
+
+	// Point the key of the first record right before the end of the
+	// address space, so that offset + length overflows.
+	data, err := os.ReadFile(fpath + SnapshotSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	numRecords := le.Uint64(data[32:])
+	blobLen := le.Uint64(data[48:])
+	recordsPos := uint64(len(data)) - numRecords*snapshotRecordSize - blobLen
+	le.PutUint64(data[recordsPos:], ^uint64(0)-1)
+	if err := os.WriteFile(fpath+SnapshotSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err = NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	if dl.snapshot != nil {
+		t.Error("corrupted snapshot should not be used")
+	}
+	if resp := dl.IsCidBlocked(testCid1); resp.Status != StatusBlocked {
+		t.Errorf("expected blocked: %s", resp)
+	}
+}
+
+func TestSnapshotRewrite(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+	old := snapshotRewriteSize
+	snapshotRewriteSize = 1
+	t.Cleanup(func() { snapshotRewriteSize = old })
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fpath, "/ipfs/"+testCid1.String()+"\n")
+	dl, err := NewDenylist(fpath, true, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid1) })
+
+	// Appended rules are added to the snapshot while following.
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("/ipfs/" + testCid2.String() + "\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, StatusBlocked, func() StatusResponse { return dl.IsCidBlocked(testCid2) })
+
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap, err := openSnapshot(fpath + SnapshotSuffix)
+		if err == nil {
+			covered := snap.offset
+			snap.close()
+			if covered == fi.Size() {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot was not rewritten")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	dl2, err := NewDenylist(fpath, false, WithSnapshots(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl2.Close()
+	if n := len(dl2.Entries); dl2.snapshot == nil || n != 0 {
+		t.Errorf("the rewritten snapshot should cover every rule, %d parsed", n)
+	}
+	for _, c := range []cid.Cid{testCid1, testCid2} {
+		if resp := dl2.IsCidBlocked(c); resp.Status != StatusBlocked {
+			t.Errorf("%s: expected blocked, got %s", c, resp)
+		}
+	}
+}
+
+func TestSnapshotEntries(t *testing.T) {
+	logging.SetLogLevel("nopfs", "ERROR")
+
+	fpath := filepath.Join(t.TempDir(), "test.deny")
+	writeTestDenylist(t, fpath, `hints:
+  gateway_status: 451
+---
+/ipfs/`+testCid1.String()+`/a/*/b* reason=x expires=2999-01-01T00:00:00Z
+-/ipfs/`+testCid2.String()+` not_before=2020-01-01T00:00:00+02:00
+/ipns/example.com/sub
+`)
+	paths := []string{
+		"/ipfs/" + testCid1.String() + "/a/x/bc",
+		"/ipfs/" + testCid2.String(),
+		"/ipns/example.com/sub",
+	}
+
+	var expected []Entry
+	for i := 0; i < 2; i++ {
+		dl, err := NewDenylist(fpath, false, WithSnapshots(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded := dl.snapshot != nil; loaded != (i == 1) {
+			t.Fatalf("snapshot loaded: %t", loaded)
+		}
+		for j, p := range paths {
+			pp, err := path.NewPath(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := dl.IsPathBlocked(pp).Entry
+			if i == 0 {
+				expected = append(expected, e)
+				continue
+			}
+			if !reflect.DeepEqual(e, expected[j]) {
+				t.Errorf("%s: expected %#v, got %#v", p, expected[j], e)
+			}
+		}
+		dl.Close()
+	}
+}
@@ -2,6 +2,8 @@ package nopfs
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
 
 	"github.com/ipfs/boxo/path"
 	"github.com/ipfs/go-cid"
@@ -63,6 +65,35 @@ func (r StatusResponse) String() string {
 	)
 }
 
+// DefaultBlockedHTTPStatus is the HTTP status code for blocked content
+// when the matching rule does not specify one with the "gateway_status" hint.
+const DefaultBlockedHTTPStatus = http.StatusGone
+
+// HTTPStatus returns the HTTP status code that a gateway should use to
+// respond for the item in the StatusResponse. For blocked items, this is
+// the value of the "gateway_status" hint of the matching rule, which can be
+// set for the whole denylist in its header. When not set, or not a 4xx or
+// 5xx code, DefaultBlockedHTTPStatus (410) is returned. Errored responses
+// return 500 and allowed or not found items return 200.
+func (r StatusResponse) HTTPStatus() int {
+	switch r.Status {
+	case StatusBlocked:
+		v, ok := r.Entry.Hint(HintGatewayStatus)
+		if !ok {
+			return DefaultBlockedHTTPStatus
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 400 || code > 599 {
+			return DefaultBlockedHTTPStatus
+		}
+		return code
+	case StatusErrored:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusOK
+	}
+}
+
 // ToError returns nil if the Status of the StatusResponse is Allowed or Not Found.
 // When the status is Blocked or Errored, it returns a StatusError.
 func (r StatusResponse) ToError() *StatusError {
@@ -79,6 +110,12 @@ type StatusError struct {
 	Response StatusResponse
 }
 
+// HTTPStatus returns the HTTP status code that a gateway should use to
+// respond with this error. See StatusResponse.HTTPStatus().
+func (err *StatusError) HTTPStatus() int {
+	return err.Response.HTTPStatus()
+}
+
 func (err *StatusError) Error() string {
 	if err := err.Response.Error; err != nil {
 		return err.Error()
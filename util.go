@@ -8,34 +8,38 @@ import (
 	"strings"
 )
 
-// GetDenylistFiles returns a list of ".deny" files found in
-// $XDG_CONFIG_HOME/ipfs/denylists and /etc/ipfs/denylists. The files are
-// sortered by their names in their respective directories.
-func GetDenylistFiles() ([]string, error) {
-	// First, look for denylists in $XDG_CONFIG_HOME/ipfs/denylists
+// GetDenylistDirs returns the default folders in which denylists are
+// looked for: $XDG_CONFIG_HOME/ipfs/denylists and /etc/ipfs/denylists.
+func GetDenylistDirs() []string {
 	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
 	if xdgConfigHome == "" {
 		xdgConfigHome = os.Getenv("HOME") + "/.config"
 	}
-	ipfsDenylistPath := filepath.Join(xdgConfigHome, "ipfs", "denylists")
-	ipfsDenylistFiles, err := GetDenylistFilesInDir(ipfsDenylistPath)
-	if err != nil {
-		return nil, err
+	return []string{
+		filepath.Join(xdgConfigHome, "ipfs", "denylists"),
+		"/etc/ipfs/denylists",
 	}
+}
 
-	// Then, look for denylists in /etc/ipfs/denylists
-	etcDenylistPath := "/etc/ipfs/denylists"
-	etcDenylistFiles, err := GetDenylistFilesInDir(etcDenylistPath)
-	if err != nil {
-		return nil, err
+// GetDenylistFiles returns a list of ".deny" and ".allow" files (see
+// Denylist.IsAllowlist) found in $XDG_CONFIG_HOME/ipfs/denylists and
+// /etc/ipfs/denylists. The files are sortered by their names in their
+// respective directories.
+func GetDenylistFiles() ([]string, error) {
+	var files []string
+	for _, dir := range GetDenylistDirs() {
+		dirFiles, err := GetDenylistFilesInDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
 	}
-
-	return append(ipfsDenylistFiles, etcDenylistFiles...), nil
+	return files, nil
 }
 
-// GetDenylistFilesInDir returns a list of ".deny" files found in the given
-// directory. The files are sortered by their names. It returns an empty list
-// and no error if the directory does not exist.
+// GetDenylistFilesInDir returns a list of ".deny" and ".allow" files found in
+// the given directory. The files are sortered by their names. It returns an
+// empty list and no error if the directory does not exist.
 func GetDenylistFilesInDir(dirpath string) ([]string, error) {
 	var denylistFiles []string
 
@@ -44,7 +48,7 @@ func GetDenylistFilesInDir(dirpath string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() && filepath.Ext(path) == ".deny" {
+		if !d.IsDir() && isDenylistFile(path) {
 			denylistFiles = append(denylistFiles, path)
 		}
 		return nil
@@ -55,6 +59,17 @@ func GetDenylistFilesInDir(dirpath string) ([]string, error) {
 	return denylistFiles, nil
 }
 
+// isDenylistFile returns true for paths with the ".deny" extension, and for
+// allowlists.
+func isDenylistFile(path string) bool {
+	return filepath.Ext(path) == ".deny" || isAllowlistFile(path)
+}
+
+// isAllowlistFile returns true for paths with the ".allow" extension.
+func isAllowlistFile(path string) bool {
+	return filepath.Ext(path) == ".allow"
+}
+
 // cutPrefix imported from go1.20
 func cutPrefix(s, prefix string) (after string, found bool) {
 	if !strings.HasPrefix(s, prefix) {